@@ -0,0 +1,266 @@
+// Package client obtains Tailbone tokens for Go programs running on the tailnet.
+//
+// A TokenSource gets tokens from the issuer's /issue endpoint, which identifies the caller by its
+// tailnet address, and caches them until shortly before they expire. It implements
+// golang.org/x/oauth2.TokenSource, so it can be used wherever OAuth 2.0 tokens are expected:
+//
+//	source, err := client.NewTokenSource(client.Config{
+//		IssuerURL: "http://tailbone",
+//		Audience:  []string{"billing-service"},
+//	})
+//	if err != nil { ... }
+//	defer source.Close()
+//
+//	httpClient := client.NewHTTPClient(source, nil)
+//	resp, err := httpClient.Get("http://billing/invoices")
+//
+// Programs embedding tsnet pass the tsnet server's HTTP client in Config.HTTPClient.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// DefaultRefreshBefore is how long before a token expires a new one is fetched in the background
+	DefaultRefreshBefore = time.Minute
+	// expiryDelta is how long before a token expires it is no longer handed out
+	expiryDelta = 10 * time.Second
+	// retryInterval is how long to wait before retrying a failed background refresh
+	retryInterval = 10 * time.Second
+	// fetchTimeout limits a request to the issuer, which is shared by every caller waiting for it
+	fetchTimeout = 30 * time.Second
+	// maxResponseSize limits the size of issuer responses
+	maxResponseSize = 64 << 10
+)
+
+// ErrClosed is returned by a TokenSource after Close
+var ErrClosed = errors.New("token source is closed")
+
+// Config configures a TokenSource
+type Config struct {
+	// IssuerURL is the URL of the Tailbone issuer on the tailnet, e.g. http://tailbone
+	IssuerURL string
+	// Audience of the requested tokens, if any
+	Audience []string
+	// RefreshBefore is how long before a token expires a new one is fetched in the background,
+	// DefaultRefreshBefore if zero. It is capped to half of the token lifetime
+	RefreshBefore time.Duration
+	// HTTPClient calls the issuer, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// OnToken, if set, is called with every new token, including those fetched in the background.
+	// Calls are never concurrent
+	OnToken func(*oauth2.Token)
+}
+
+// TokenSource obtains tokens from the issuer and caches them. It is safe for concurrent use
+type TokenSource struct {
+	config Config
+	// fetches is used so concurrent callers share a single request to the issuer
+	fetches singleflight.Group
+
+	mu     sync.Mutex
+	token  *oauth2.Token
+	timer  *time.Timer
+	closed bool
+}
+
+var _ oauth2.TokenSource = (*TokenSource)(nil)
+
+// issueResponse is the response of the issuer's /issue endpoint
+type issueResponse struct {
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+}
+
+// NewTokenSource creates a token source. The first token is fetched on first use
+func NewTokenSource(config Config) (*TokenSource, error) {
+	if config.IssuerURL == "" {
+		return nil, errors.New("issuer URL is required")
+	}
+	if config.RefreshBefore == 0 {
+		config.RefreshBefore = DefaultRefreshBefore
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	config.IssuerURL = strings.TrimSuffix(config.IssuerURL, "/")
+
+	return &TokenSource{config: config}, nil
+}
+
+// Token returns a cached token, or fetches a new one if there is none that is still valid
+func (s *TokenSource) Token() (*oauth2.Token, error) {
+	return s.TokenContext(context.Background())
+}
+
+// TokenContext is Token with a context for the request to the issuer
+func (s *TokenSource) TokenContext(ctx context.Context) (*oauth2.Token, error) {
+	s.mu.Lock()
+	token, closed := s.token, s.closed
+	s.mu.Unlock()
+
+	if closed {
+		return nil, ErrClosed
+	}
+	if token != nil && time.Now().Before(token.Expiry.Add(-expiryDelta)) {
+		return token, nil
+	}
+
+	return s.refresh(ctx)
+}
+
+// Close stops refreshing tokens in the background
+func (s *TokenSource) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// refresh fetches a new token and schedules the next background refresh. Concurrent callers
+// wait for the same request, which is not canceled when one of them gives up
+func (s *TokenSource) refresh(ctx context.Context) (*oauth2.Token, error) {
+	result := s.fetches.DoChan("token", func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), fetchTimeout)
+		defer cancel()
+
+		token, err := s.fetch(fetchCtx)
+		if err != nil {
+			return nil, err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return nil, ErrClosed
+		}
+		s.token = token
+		s.schedule(token)
+		s.mu.Unlock()
+
+		if s.config.OnToken != nil {
+			s.config.OnToken(token)
+		}
+		return token, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-result:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*oauth2.Token), nil
+	}
+}
+
+// schedule refreshes the token in the background shortly before it expires. The caller must hold mu
+func (s *TokenSource) schedule(token *oauth2.Token) {
+	refreshBefore := s.config.RefreshBefore
+	if lifetime := time.Until(token.Expiry); refreshBefore > lifetime/2 {
+		refreshBefore = lifetime / 2
+	}
+
+	s.scheduleIn(time.Until(token.Expiry.Add(-refreshBefore)))
+}
+
+func (s *TokenSource) scheduleIn(delay time.Duration) {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = time.AfterFunc(delay, s.backgroundRefresh)
+}
+
+// backgroundRefresh refreshes the cached token, retrying until Close if the issuer is unavailable
+func (s *TokenSource) backgroundRefresh() {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+
+	if closed {
+		return
+	}
+
+	if _, err := s.refresh(context.Background()); err != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.closed {
+			s.scheduleIn(retryInterval)
+		}
+	}
+}
+
+// fetch requests a new token from the issuer
+func (s *TokenSource) fetch(ctx context.Context) (*oauth2.Token, error) {
+	form := url.Values{}
+	for _, audience := range s.config.Audience {
+		form.Add("audience", audience)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.IssuerURL+"/issue", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to request token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var issued issueResponse
+	if err := json.Unmarshal(body, &issued); err != nil {
+		return nil, fmt.Errorf("failed to parse token response: %w", err)
+	}
+	if issued.Token == "" {
+		return nil, errors.New("token response has no token")
+	}
+
+	// the issuer is trusted, the token is only parsed to learn when it expires
+	claims := &jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(issued.Token, claims); err != nil {
+		return nil, fmt.Errorf("failed to parse token: %w", err)
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("token has no expiry")
+	}
+
+	tokenType := issued.TokenType
+	if tokenType == "" {
+		tokenType = "Bearer"
+	}
+
+	return &oauth2.Token{
+		AccessToken: issued.Token,
+		TokenType:   tokenType,
+		Expiry:      claims.ExpiresAt.Time,
+	}, nil
+}
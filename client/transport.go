@@ -0,0 +1,57 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// Transport is an http.RoundTripper that adds a token to the Authorization header of each request
+type Transport struct {
+	// Source provides the tokens
+	Source oauth2.TokenSource
+	// Base sends the requests, http.DefaultTransport if nil
+	Base http.RoundTripper
+}
+
+// NewHTTPClient returns an HTTP client that sends requests with tokens from source, using the
+// transport of base, or http.DefaultTransport if base is nil
+func NewHTTPClient(source oauth2.TokenSource, base *http.Client) *http.Client {
+	client := &http.Client{}
+	if base != nil {
+		*client = *base
+	}
+	client.Transport = &Transport{Source: source, Base: client.Transport}
+	return client
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	closeBody := func() {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+	}
+
+	if t.Source == nil {
+		closeBody()
+		return nil, errors.New("transport has no token source")
+	}
+
+	token, err := t.Source.Token()
+	if err != nil {
+		closeBody()
+		return nil, err
+	}
+
+	// a RoundTripper must not modify the request
+	authorized := req.Clone(req.Context())
+	token.SetAuthHeader(authorized)
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(authorized)
+}
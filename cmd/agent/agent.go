@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/altacoda/tailbone/core"
+	"github.com/altacoda/tailbone/utils"
+)
+
+var Cmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Run a local token agent",
+	Long: `Run an agent that fetches tokens from the issuer, refreshes them before they expire and
+serves them to local processes over a Unix socket. Tokens can also be written to files,
+which are replaced atomically on every refresh.`,
+	Args: cobra.NoArgs,
+	PreRun: func(cmd *cobra.Command, _ []string) {
+		viper.BindPFlag("log.level", cmd.Flags().Lookup("log-level"))
+		viper.BindPFlag("log.format", cmd.Flags().Lookup("log-format"))
+		viper.BindPFlag("token.issuerUrl", cmd.Flags().Lookup("issuer-url"))
+		viper.BindPFlag("agent.socket", cmd.Flags().Lookup("socket"))
+		viper.BindPFlag("agent.audiences", cmd.Flags().Lookup("audience"))
+		viper.BindPFlag("agent.sinks", cmd.Flags().Lookup("sink"))
+	},
+	RunE: runAgent,
+}
+
+func init() {
+	Cmd.Flags().String("log-level", "info", "Log level (trace, debug, info, warn, error)")
+	Cmd.Flags().String("log-format", "console", "Log format (console, json)")
+	Cmd.Flags().String("issuer-url", "", "URL of the Tailbone issuer")
+	Cmd.Flags().String("socket", filepath.Join(os.TempDir(), "tailbone-agent.sock"), "Path of the Unix socket tokens are served on")
+	Cmd.Flags().StringSlice("audience", []string{}, "Audiences tokens are served for, each gets its own token fetched at startup")
+	Cmd.Flags().StringArray("sink", []string{}, "Write the token for an audience to a file, as audience=path")
+}
+
+func runAgent(_ *cobra.Command, _ []string) error {
+	utils.InitLogger()
+	logger := utils.GetLogger("agent")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, err := core.NewAgentListener()
+	if err != nil {
+		return fmt.Errorf("failed to create agent listener: %w", err)
+	}
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			logger.Error().Err(err).Msg("agent listener error")
+			cancel()
+		}
+	}()
+
+	utils.WaitForSignal(ctx)
+	logger.Info().Msg("shutting down agent")
+	srv.Stop()
+
+	return nil
+}
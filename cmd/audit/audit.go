@@ -0,0 +1,18 @@
+package audit
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/altacoda/tailbone/utils"
+)
+
+var Cmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Audit log commands",
+	Long: `Audit log commands for the Tailbone identity server.
+These commands allow you to inspect the record of admin actions and issued tokens.`,
+}
+
+func init() {
+	utils.AddAdminClientFlags(Cmd)
+}
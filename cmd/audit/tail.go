@@ -0,0 +1,72 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+
+	"github.com/altacoda/tailbone/proto"
+	"github.com/altacoda/tailbone/utils"
+)
+
+var tailCmd = &cobra.Command{
+	Use:   "tail",
+	Short: "Show the most recent audit events",
+	Long: `Show the most recent audit events recorded by the server.
+Events include admin actions and issued tokens with the identity of the caller.`,
+	RunE: runTail,
+}
+
+func init() {
+	Cmd.AddCommand(tailCmd)
+
+	tailCmd.Flags().Int32P("lines", "n", 20, "Number of events to show")
+}
+
+func runTail(cmd *cobra.Command, _ []string) error {
+	ctx := context.Background()
+	lines, _ := cmd.Flags().GetInt32("lines")
+
+	client, err := utils.NewAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.TailAudit(ctx, &proto.TailAuditRequest{
+		Limit: lines,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to tail audit log: %w", err)
+	}
+
+	if len(resp.Events) == 0 {
+		fmt.Fprintln(os.Stderr, "No audit events found")
+		return nil
+	}
+
+	out := utils.OutData{
+		Headers: table.Row{"Time", "Action", "Actor", "Node", "KeyId", "Jti", "Outcome"},
+		Rows:    []table.Row{},
+	}
+
+	for _, event := range resp.Events {
+		actor := event.Actor
+		if len(event.ActorTags) > 0 {
+			actor = strings.Join(event.ActorTags, ",")
+		}
+		outcome := event.Outcome
+		if event.Error != "" {
+			outcome = fmt.Sprintf("%s: %s", event.Outcome, event.Error)
+		}
+
+		out.Rows = append(out.Rows, table.Row{time.Unix(event.Time, 0).Format(time.RFC3339), event.Action, actor, event.ActorNode, event.Kid, event.Jti, outcome})
+		out.RawData = append(out.RawData, event)
+	}
+
+	return utils.Print(out)
+}
@@ -0,0 +1,38 @@
+package clients
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+
+	"github.com/altacoda/tailbone/proto"
+	"github.com/altacoda/tailbone/utils"
+)
+
+var Cmd = &cobra.Command{
+	Use:     "clients",
+	Aliases: []string{"client"},
+	Short:   "Client management commands",
+	Long: `Client management commands for the Tailbone identity server.
+These commands allow you to register and manage the OAuth 2.0 / OIDC clients
+that can use the token endpoints of the issuer.`,
+}
+
+func init() {
+	utils.AddAdminClientFlags(Cmd)
+}
+
+var clientHeaders = table.Row{"ClientId", "Public", "GrantTypes", "RedirectURIs", "Audiences", "Created"}
+
+func clientRow(client *proto.Client) table.Row {
+	return table.Row{
+		client.ClientId,
+		client.Public,
+		strings.Join(client.GrantTypes, ", "),
+		strings.Join(client.RedirectUris, ", "),
+		strings.Join(client.Audiences, ", "),
+		time.Unix(client.CreatedAt, 0).Format(time.RFC3339),
+	}
+}
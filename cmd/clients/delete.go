@@ -0,0 +1,51 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/altacoda/tailbone/proto"
+	"github.com/altacoda/tailbone/utils"
+)
+
+var deleteCmd = &cobra.Command{
+	Use:     "delete [clientID]",
+	Aliases: []string{"rm"},
+	Short:   "Delete a registered client",
+	Long: `Delete a client from the issuer. The client can no longer use the token endpoints.
+Tokens already issued to it stay valid until they expire or are revoked.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runDelete,
+}
+
+func init() {
+	Cmd.AddCommand(deleteCmd)
+
+	deleteCmd.Flags().BoolP("yes", "y", false, "Skip confirmation prompt")
+}
+
+func runDelete(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	clientID := args[0]
+
+	yes, _ := cmd.Flags().GetBool("yes")
+
+	if yes || utils.ExpectYes(fmt.Sprintf("Are you sure you want to delete client %s?", clientID)) {
+		client, err := utils.NewAdminClient(ctx)
+		if err != nil {
+			return err
+		}
+
+		if _, err := client.DeleteClient(ctx, &proto.DeleteClientRequest{
+			ClientId: clientID,
+		}); err != nil {
+			return fmt.Errorf("failed to delete client: %w", err)
+		}
+
+		fmt.Printf("Client %s deleted\n", clientID)
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+
+	"github.com/altacoda/tailbone/proto"
+	"github.com/altacoda/tailbone/utils"
+)
+
+var listCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List registered clients",
+	Long:    `List all clients registered with the issuer. Client secrets are never shown.`,
+	RunE:    runList,
+}
+
+func init() {
+	Cmd.AddCommand(listCmd)
+}
+
+func runList(_ *cobra.Command, _ []string) error {
+	ctx := context.Background()
+
+	client, err := utils.NewAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.ListClients(ctx, &proto.ListClientsRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list clients: %w", err)
+	}
+
+	if len(resp.Clients) == 0 {
+		fmt.Fprintln(os.Stderr, "No clients found")
+		return nil
+	}
+
+	out := utils.OutData{
+		Headers: clientHeaders,
+		Rows:    []table.Row{},
+	}
+
+	for _, c := range resp.Clients {
+		out.Rows = append(out.Rows, clientRow(c))
+		out.RawData = append(out.RawData, c)
+	}
+
+	return utils.Print(out)
+}
@@ -0,0 +1,68 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+
+	"github.com/altacoda/tailbone/proto"
+	"github.com/altacoda/tailbone/utils"
+)
+
+var registerCmd = &cobra.Command{
+	Use:   "register [clientID]",
+	Short: "Register a new client",
+	Long: `Register a new client with the issuer. A client ID is generated if none is given.
+Unless --public is set, a client secret is generated and shown once. It cannot be retrieved later.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runRegister,
+}
+
+func init() {
+	Cmd.AddCommand(registerCmd)
+
+	registerCmd.Flags().StringSlice("redirect-uri", []string{}, "Allowed redirect URI (authorization_code grant)")
+	registerCmd.Flags().StringSlice("audience", []string{}, "Audience the client can request tokens for (default is the client ID)")
+	registerCmd.Flags().StringSlice("grant-type", []string{}, "Grant type the client can use: authorization_code, client_credentials, urn:ietf:params:oauth:grant-type:token-exchange (default is authorization_code)")
+	registerCmd.Flags().Bool("public", false, "Register a public client without a secret. Public clients must use PKCE")
+}
+
+func runRegister(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	req := &proto.RegisterClientRequest{}
+	if len(args) > 0 {
+		req.ClientId = args[0]
+	}
+	req.RedirectUris, _ = cmd.Flags().GetStringSlice("redirect-uri")
+	req.Audiences, _ = cmd.Flags().GetStringSlice("audience")
+	req.GrantTypes, _ = cmd.Flags().GetStringSlice("grant-type")
+	req.Public, _ = cmd.Flags().GetBool("public")
+
+	client, err := utils.NewAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.RegisterClient(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to register client: %w", err)
+	}
+
+	out := utils.OutData{
+		Headers: append(clientHeaders, "Secret"),
+		Rows:    []table.Row{},
+	}
+
+	out.Rows = append(out.Rows, append(clientRow(resp.Client), resp.ClientSecret))
+	out.RawData = append(out.RawData, resp)
+
+	if resp.ClientSecret != "" {
+		fmt.Fprintln(os.Stderr, "Store the client secret now. It cannot be retrieved later.")
+	}
+
+	return utils.Print(out)
+}
@@ -0,0 +1,49 @@
+package credentialhelper
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/oauth2"
+
+	"github.com/altacoda/tailbone/utils"
+)
+
+// defaultUsername is sent with tokens by helpers whose protocol requires a username
+const defaultUsername = "tailbone"
+
+var Cmd = &cobra.Command{
+	Use:   "credential-helper",
+	Short: "Credential helpers for git, Docker and Kubernetes",
+	Long: `Credential helpers that let git, Docker and kubectl authenticate with Tailbone tokens.
+Tokens are requested from the issuer and cached on disk until shortly before they expire.`,
+}
+
+// addHelperFlags adds the flags shared by all helpers
+func addHelperFlags(cmd *cobra.Command) {
+	utils.AddTokenClientFlags(cmd)
+	cmd.Flags().StringSlice("audience", []string{}, "Audience of the token")
+}
+
+// helperAudience returns the audience set with --audience, or fallback if there is none. Tokens
+// are never requested without an audience, as they would be accepted by any service
+func helperAudience(cmd *cobra.Command, fallback string) ([]string, error) {
+	audience, _ := cmd.Flags().GetStringSlice("audience")
+	if len(audience) > 0 {
+		return audience, nil
+	}
+	if fallback == "" {
+		return nil, fmt.Errorf("no audience given, set --audience")
+	}
+	return []string{fallback}, nil
+}
+
+// getToken returns a cached or new token for the audience
+func getToken(audience []string) (*oauth2.Token, error) {
+	token, err := utils.GetToken(context.Background(), audience, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token: %w", err)
+	}
+	return token, nil
+}
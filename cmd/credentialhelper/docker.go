@@ -0,0 +1,139 @@
+package credentialhelper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/altacoda/tailbone/utils"
+)
+
+var dockerCmd = &cobra.Command{
+	Use:   "docker <get|store|erase|list>",
+	Short: "Docker credential helper",
+	Long: `Docker credential helper that answers with a Tailbone token as secret. The token is
+issued for --audience, or for the registry host Docker asks credentials for if it is not set.
+
+Docker runs credential helpers as docker-credential-<name>, so install a wrapper such as
+/usr/local/bin/docker-credential-tailbone:
+
+  #!/bin/sh
+  exec tailbone credential-helper docker "$@"
+
+and configure it for a registry in ~/.docker/config.json:
+
+  {"credHelpers": {"registry.example.com": "tailbone"}}`,
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: []string{"get", "store", "erase", "list"},
+	RunE:      runDocker,
+}
+
+// dockerCredentials are the credentials returned to Docker
+type dockerCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+func init() {
+	Cmd.AddCommand(dockerCmd)
+
+	addHelperFlags(dockerCmd)
+	dockerCmd.Flags().String("username", defaultUsername, "Username sent with the token")
+}
+
+func runDocker(cmd *cobra.Command, args []string) error {
+	username, _ := cmd.Flags().GetString("username")
+
+	switch args[0] {
+	case "get":
+		serverURL, err := readServerURL()
+		if err != nil {
+			return err
+		}
+
+		audience, err := registryAudience(cmd, serverURL)
+		if err != nil {
+			return err
+		}
+
+		token, err := getToken(audience)
+		if err != nil {
+			return err
+		}
+
+		return json.NewEncoder(os.Stdout).Encode(dockerCredentials{
+			ServerURL: serverURL,
+			Username:  username,
+			Secret:    token.AccessToken,
+		})
+	case "erase":
+		serverURL, err := readServerURL()
+		if err != nil {
+			return err
+		}
+		audience, err := registryAudience(cmd, serverURL)
+		if err != nil {
+			return err
+		}
+		return utils.ForgetToken(audience)
+	case "store":
+		// tokens are cached when they are issued, credentials sent by docker login are not kept
+		_, err := io.Copy(io.Discard, os.Stdin)
+		return err
+	case "list":
+		// cached tokens are not tied to registries
+		fmt.Println("{}")
+		return nil
+	default:
+		return fmt.Errorf("unknown credential helper action %q", args[0])
+	}
+}
+
+// readServerURL reads the registry URL Docker passes on standard input
+func readServerURL() (string, error) {
+	data, err := io.ReadAll(io.LimitReader(os.Stdin, 1<<16))
+	if err != nil {
+		return "", fmt.Errorf("failed to read server URL: %w", err)
+	}
+
+	serverURL := strings.TrimSpace(string(data))
+	if serverURL == "" {
+		return "", fmt.Errorf("no server URL given")
+	}
+	return serverURL, nil
+}
+
+// registryAudience returns the audience set with --audience, or the host of the registry
+func registryAudience(cmd *cobra.Command, serverURL string) ([]string, error) {
+	if audience, _ := cmd.Flags().GetStringSlice("audience"); len(audience) > 0 {
+		return audience, nil
+	}
+
+	host, err := registryHost(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	return helperAudience(cmd, host)
+}
+
+// registryHost returns the host of a registry URL, which may be given without scheme
+func registryHost(serverURL string) (string, error) {
+	if !strings.Contains(serverURL, "://") {
+		serverURL = "https://" + serverURL
+	}
+
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse server URL: %w", err)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("no host in server URL %q", serverURL)
+	}
+	return u.Host, nil
+}
@@ -0,0 +1,93 @@
+package credentialhelper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// execCredentialAPIVersion is the ExecCredential version used when kubectl does not pass one
+	execCredentialAPIVersion = "client.authentication.k8s.io/v1"
+	// execInfoEnv is the variable kubectl passes the ExecCredential request in
+	execInfoEnv = "KUBERNETES_EXEC_INFO"
+	// execDefaultAudience matches the default audience of the TokenReview webhook
+	execDefaultAudience = "kubernetes"
+)
+
+var execCmd = &cobra.Command{
+	Use:   "exec",
+	Short: "Kubernetes exec credential plugin",
+	Long: `Kubernetes client-go credential plugin that prints an ExecCredential with a Tailbone
+token, for clusters that authenticate tokens with the Tailbone TokenReview webhook.
+
+Tokens are issued for the "kubernetes" audience unless --audience is set. Configure it for a
+user in kubeconfig:
+
+  users:
+    - name: tailbone
+      user:
+        exec:
+          apiVersion: client.authentication.k8s.io/v1
+          command: tailbone
+          args: ["credential-helper", "exec"]
+          interactiveMode: Never`,
+	Args: cobra.NoArgs,
+	RunE: runExec,
+}
+
+// execCredential is the Kubernetes client-go credential plugin response
+type execCredential struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Status     *execCredentialStatus `json:"status,omitempty"`
+}
+
+// execCredentialStatus holds the credential of an ExecCredential
+type execCredentialStatus struct {
+	Token               string    `json:"token"`
+	ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+}
+
+func init() {
+	Cmd.AddCommand(execCmd)
+
+	addHelperFlags(execCmd)
+}
+
+func runExec(cmd *cobra.Command, _ []string) error {
+	apiVersion := execCredentialAPIVersion
+
+	// answer in the version kubectl asks for
+	if info := os.Getenv(execInfoEnv); info != "" {
+		var request execCredential
+		if err := json.Unmarshal([]byte(info), &request); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", execInfoEnv, err)
+		}
+		if request.APIVersion != "" {
+			apiVersion = request.APIVersion
+		}
+	}
+
+	audience, err := helperAudience(cmd, execDefaultAudience)
+	if err != nil {
+		return err
+	}
+
+	token, err := getToken(audience)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(execCredential{
+		APIVersion: apiVersion,
+		Kind:       "ExecCredential",
+		Status: &execCredentialStatus{
+			Token:               token.AccessToken,
+			ExpirationTimestamp: token.Expiry.UTC(),
+		},
+	})
+}
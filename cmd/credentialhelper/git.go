@@ -0,0 +1,98 @@
+package credentialhelper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/altacoda/tailbone/utils"
+)
+
+var gitCmd = &cobra.Command{
+	Use:   "git <get|store|erase>",
+	Short: "Git credential helper",
+	Long: `Git credential helper that answers with a Tailbone token as password. The token is
+issued for --audience, or for the host git asks credentials for if it is not set. Tokens
+git reports as rejected are removed from the cache.
+
+Configure it for a host with:
+
+  git config --global credential.https://git.example.com.helper "!tailbone credential-helper git"`,
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: []string{"get", "store", "erase"},
+	RunE:      runGit,
+}
+
+func init() {
+	Cmd.AddCommand(gitCmd)
+
+	addHelperFlags(gitCmd)
+	gitCmd.Flags().String("username", defaultUsername, "Username sent with the token")
+}
+
+func runGit(cmd *cobra.Command, args []string) error {
+	username, _ := cmd.Flags().GetString("username")
+
+	attributes, err := readGitAttributes(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "get":
+		audience, err := helperAudience(cmd, attributes["host"])
+		if err != nil {
+			return err
+		}
+
+		token, err := getToken(audience)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("username=%s\n", username)
+		fmt.Printf("password=%s\n", token.AccessToken)
+		fmt.Printf("password_expiry_utc=%d\n", token.Expiry.Unix())
+		return nil
+	case "erase":
+		audience, err := helperAudience(cmd, attributes["host"])
+		if err != nil {
+			return err
+		}
+		return utils.ForgetToken(audience)
+	case "store":
+		// tokens are cached when they are issued
+		return nil
+	default:
+		// git ignores actions helpers do not know
+		return nil
+	}
+}
+
+// readGitAttributes reads the key=value lines git passes to credential helpers, up to an empty line
+func readGitAttributes(r io.Reader) (map[string]string, error) {
+	attributes := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid credential attribute %q", line)
+		}
+		attributes[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read credential attributes: %w", err)
+	}
+	return attributes, nil
+}
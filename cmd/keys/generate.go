@@ -16,7 +16,9 @@ var generateCmd = &cobra.Command{
 	Use:   "generate",
 	Short: "Generate a new signing key pair",
 	Long: `Generate a new RSA key pair for signing JWTs.
-The keys will be saved in JWK format with the key ID and timestamp in the filename.`,
+The keys will be saved in JWK format with the key ID and timestamp in the filename.
+Use --type to generate a certificate authority key instead. CA keys are kept in a
+subdirectory of the key directory named after their type and the updated CA bundle is published.`,
 	RunE: runGenerate,
 	PreRun: func(cmd *cobra.Command, _ []string) {
 		viper.BindPFlag("host", cmd.PersistentFlags().Lookup("host"))
@@ -26,28 +28,32 @@ The keys will be saved in JWK format with the key ID and timestamp in the filena
 func init() {
 	Cmd.AddCommand(generateCmd)
 	generateCmd.Flags().IntP("size", "s", 2048, "RSA key size in bits")
+	generateCmd.Flags().StringP("type", "t", string(utils.KeyTypeJWT), "Key type (jwt, x509-ca, ssh-ca)")
 	viper.BindPFlag("keys.size", generateCmd.Flags().Lookup("size"))
 }
 
-func runGenerate(_ *cobra.Command, _ []string) error {
+func runGenerate(cmd *cobra.Command, _ []string) error {
 	ctx := context.Background()
+	keyType, _ := cmd.Flags().GetString("type")
 
-	client, err := getAdminClient(ctx)
+	client, err := utils.NewAdminClient(ctx)
 	if err != nil {
 		return err
 	}
 
-	resp, err := client.GenerateNewKeys(ctx, &proto.GenerateNewKeysRequest{})
+	resp, err := client.GenerateNewKeys(ctx, &proto.GenerateNewKeysRequest{
+		Type: keyType,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to generate keys: %w", err)
 	}
 
 	out := utils.OutData{
-		Headers: table.Row{"KeyId", "Algorithm"},
+		Headers: table.Row{"KeyId", "Type", "Algorithm"},
 		Rows:    []table.Row{},
 	}
 
-	out.Rows = append(out.Rows, table.Row{resp.Key.KeyId, resp.Key.Algorithm})
+	out.Rows = append(out.Rows, table.Row{resp.Key.KeyId, resp.Key.Type, resp.Key.Algorithm})
 	out.RawData = append(out.RawData, resp)
 
 	return utils.Print(out)
@@ -23,23 +23,29 @@ var listCmd = &cobra.Command{
 	Short:   "List available signing keys",
 	Long: `List all available signing keys.
 By default, lists keys from the configured JWKS endpoint.
-Use --local flag to list keys from the local filesystem instead.`,
+Use --local flag to list keys from the local filesystem instead.
+Use --type to list the keys of a certificate authority.`,
 	RunE: runList,
 }
 
 func init() {
 	Cmd.AddCommand(listCmd)
+
+	listCmd.Flags().StringP("type", "t", string(utils.KeyTypeJWT), "Key type (jwt, x509-ca, ssh-ca)")
 }
 
-func runList(_ *cobra.Command, _ []string) error {
+func runList(cmd *cobra.Command, _ []string) error {
 	ctx := context.Background()
+	keyType, _ := cmd.Flags().GetString("type")
 
-	client, err := getAdminClient(ctx)
+	client, err := utils.NewAdminClient(ctx)
 	if err != nil {
 		return err
 	}
 
-	resp, err := client.ListKeys(ctx, &proto.ListKeysRequest{})
+	resp, err := client.ListKeys(ctx, &proto.ListKeysRequest{
+		Type: keyType,
+	})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Failed to list keys")
 		return err
@@ -51,12 +57,16 @@ func runList(_ *cobra.Command, _ []string) error {
 	}
 
 	out := utils.OutData{
-		Headers: table.Row{"KeyId", "Algorithm", "Created"},
+		Headers: table.Row{"KeyId", "Algorithm", "Created", "Expires"},
 		Rows:    []table.Row{},
 	}
 
 	for _, key := range resp.Keys {
-		out.Rows = append(out.Rows, table.Row{key.KeyId, key.Algorithm, time.Unix(key.CreatedAt, 0).Format(time.RFC3339)})
+		expires := ""
+		if key.ExpiresAt != 0 {
+			expires = time.Unix(key.ExpiresAt, 0).Format(time.RFC3339)
+		}
+		out.Rows = append(out.Rows, table.Row{key.KeyId, key.Algorithm, time.Unix(key.CreatedAt, 0).Format(time.RFC3339), expires})
 		out.RawData = append(out.RawData, key)
 	}
 
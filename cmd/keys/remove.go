@@ -16,7 +16,8 @@ var removeCmd = &cobra.Command{
 	Use:   "remove [keyID]",
 	Short: "Remove a key from the JWKS in S3",
 	Long: `Remove a key from the JSON Web Key Set (JWKS) stored in S3.
-This will download the current JWKS, remove the specified key, and upload the updated JWKS.`,
+This will download the current JWKS, remove the specified key, and upload the updated JWKS.
+Use --type to remove a certificate authority key, which also publishes the updated CA bundle.`,
 	Args: cobra.ExactArgs(1),
 	RunE: runRemove,
 }
@@ -25,22 +26,25 @@ func init() {
 	Cmd.AddCommand(removeCmd)
 
 	removeCmd.Flags().BoolP("yes", "y", false, "Skip confirmation prompt")
+	removeCmd.Flags().StringP("type", "t", string(utils.KeyTypeJWT), "Key type (jwt, x509-ca, ssh-ca)")
 }
 
-func runRemove(_ *cobra.Command, args []string) error {
+func runRemove(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 	keyID := args[0]
 
-	yes, _ := removeCmd.Flags().GetBool("yes")
+	yes, _ := cmd.Flags().GetBool("yes")
+	keyType, _ := cmd.Flags().GetString("type")
 
 	if yes || utils.ExpectYes("Are you sure you want to remove key?. This operation is not reversible.") {
-		client, err := getAdminClient(ctx)
+		client, err := utils.NewAdminClient(ctx)
 		if err != nil {
 			return err
 		}
 
 		resp, err := client.RemoveKey(ctx, &proto.RemoveKeyRequest{
 			KeyId: keyID,
+			Type:  keyType,
 		})
 		if err != nil {
 			return fmt.Errorf("failed to remove key: %w", err)
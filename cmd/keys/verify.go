@@ -0,0 +1,68 @@
+package keys
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+
+	"github.com/altacoda/tailbone/proto"
+	"github.com/altacoda/tailbone/utils"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify local keys against the JWKS in S3",
+	Long: `Verify that every published public key is derived from the matching private key
+held by the server, and flag mismatched, missing or corrupt keys.`,
+	RunE: runVerify,
+}
+
+func init() {
+	Cmd.AddCommand(verifyCmd)
+}
+
+func runVerify(_ *cobra.Command, _ []string) error {
+	ctx := context.Background()
+
+	client, err := utils.NewAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.VerifyKeys(ctx, &proto.VerifyKeysRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to verify keys: %w", err)
+	}
+
+	if len(resp.Checks) == 0 {
+		fmt.Fprintln(os.Stderr, "No keys found")
+		return nil
+	}
+
+	out := utils.OutData{
+		Headers: table.Row{"KeyId", "Status", "Detail"},
+		Rows:    []table.Row{},
+	}
+
+	failed := 0
+	for _, check := range resp.Checks {
+		if check.Status != string(utils.KeyStatusOK) {
+			failed++
+		}
+		out.Rows = append(out.Rows, table.Row{check.KeyId, check.Status, check.Detail})
+		out.RawData = append(out.RawData, check)
+	}
+
+	if err := utils.Print(out); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d key(s) failed verification", failed)
+	}
+
+	return nil
+}
@@ -8,8 +8,13 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/altacoda/tailbone/cmd/agent"
+	"github.com/altacoda/tailbone/cmd/audit"
+	"github.com/altacoda/tailbone/cmd/clients"
+	"github.com/altacoda/tailbone/cmd/credentialhelper"
 	"github.com/altacoda/tailbone/cmd/keys"
 	"github.com/altacoda/tailbone/cmd/server"
+	"github.com/altacoda/tailbone/cmd/tokens"
 	"github.com/altacoda/tailbone/utils"
 )
 
@@ -41,6 +46,11 @@ func init() {
 	// Add commands
 	rootCmd.AddCommand(server.Cmd)
 	rootCmd.AddCommand(keys.Cmd)
+	rootCmd.AddCommand(audit.Cmd)
+	rootCmd.AddCommand(tokens.Cmd)
+	rootCmd.AddCommand(clients.Cmd)
+	rootCmd.AddCommand(credentialhelper.Cmd)
+	rootCmd.AddCommand(agent.Cmd)
 
 	// Set environment variable bindings
 	viper.SetEnvPrefix("TB")
@@ -18,10 +18,18 @@ func init() {
 	Cmd.PersistentFlags().String("dir", "keys", "Directory containing the JWK files")
 	Cmd.PersistentFlags().String("bucket", "", "S3 bucket for JWKS storage")
 	Cmd.PersistentFlags().String("key-path", ".well-known/jwks.json", "Path/key for the JWKS file in S3")
+	Cmd.PersistentFlags().String("revocations-file", "", "File the revocation list is kept in (default is revocations.json in the key directory)")
+	Cmd.PersistentFlags().String("revocations-path", ".well-known/revocations.json", "Path/key for the revocation list in S3")
+	Cmd.PersistentFlags().String("x509-bundle-path", ".well-known/tailbone-ca.pem", "Path/key for the X.509 CA bundle in S3")
+	Cmd.PersistentFlags().String("ssh-ca-path", ".well-known/tailbone-ssh-ca.pub", "Path/key for the SSH CA public keys in S3")
 
 	viper.BindPFlag("log.level", Cmd.PersistentFlags().Lookup("log-level"))
 	viper.BindPFlag("log.format", Cmd.PersistentFlags().Lookup("log-format"))
 	viper.BindPFlag("keys.dir", Cmd.PersistentFlags().Lookup("dir"))
 	viper.BindPFlag("keys.bucket", Cmd.PersistentFlags().Lookup("bucket"))
 	viper.BindPFlag("keys.keyPath", Cmd.PersistentFlags().Lookup("key-path"))
+	viper.BindPFlag("revocations.file", Cmd.PersistentFlags().Lookup("revocations-file"))
+	viper.BindPFlag("revocations.keyPath", Cmd.PersistentFlags().Lookup("revocations-path"))
+	viper.BindPFlag("x509.bundlePath", Cmd.PersistentFlags().Lookup("x509-bundle-path"))
+	viper.BindPFlag("ssh.caPath", Cmd.PersistentFlags().Lookup("ssh-ca-path"))
 }
@@ -23,16 +23,44 @@ using Tailscale for user verification.`,
 		// Bind flags to viper
 		viper.BindPFlag("server.port", cmd.Flags().Lookup("port"))
 		viper.BindPFlag("server.binding", cmd.Flags().Lookup("binding"))
+		viper.BindPFlag("server.tls", cmd.Flags().Lookup("tls"))
 		viper.BindPFlag("server.tailscale.authkey", cmd.Flags().Lookup("ts-authkey"))
 		viper.BindPFlag("server.tailscale.joinTimeout", cmd.Flags().Lookup("ts-join-timeout"))
 		viper.BindPFlag("server.tailscale.joinRetry", cmd.Flags().Lookup("ts-join-retry"))
 		viper.BindPFlag("keys.issuer", cmd.Flags().Lookup("issuer"))
 		viper.BindPFlag("keys.expiry", cmd.Flags().Lookup("expiry"))
+		viper.BindPFlag("refresh.expiry", cmd.Flags().Lookup("refresh-expiry"))
+		viper.BindPFlag("refresh.file", cmd.Flags().Lookup("refresh-file"))
+		viper.BindPFlag("clients.file", cmd.Flags().Lookup("clients-file"))
+		viper.BindPFlag("exchange.audiences", cmd.Flags().Lookup("exchange-audiences"))
+		viper.BindPFlag("oidc.baseUrl", cmd.Flags().Lookup("oidc-base-url"))
+		viper.BindPFlag("x509.expiry", cmd.Flags().Lookup("x509-expiry"))
+		viper.BindPFlag("x509.caValidity", cmd.Flags().Lookup("x509-ca-validity"))
+		viper.BindPFlag("ssh.expiry", cmd.Flags().Lookup("ssh-expiry"))
+		viper.BindPFlag("ssh.domains", cmd.Flags().Lookup("ssh-domains"))
+		viper.BindPFlag("kubernetes.audience", cmd.Flags().Lookup("kubernetes-audience"))
+		viper.BindPFlag("verify.whois", cmd.Flags().Lookup("verify-whois"))
+		viper.BindPFlag("verify.clientIPHeader", cmd.Flags().Lookup("verify-client-ip-header"))
+		viper.BindPFlag("spiffe.trustDomain", cmd.Flags().Lookup("spiffe-trust-domain"))
+		viper.BindPFlag("spiffe.template", cmd.Flags().Lookup("spiffe-id-template"))
 		viper.BindPFlag("server.tailscale.dir", cmd.Flags().Lookup("ts-dir"))
 		viper.BindPFlag("server.tailscale.hostname", cmd.Flags().Lookup("ts-hostname"))
 		viper.BindPFlag("admin.port", cmd.Flags().Lookup("admin-port"))
 		viper.BindPFlag("admin.binding", cmd.Flags().Lookup("admin-binding"))
+		viper.BindPFlag("admin.tls", cmd.Flags().Lookup("admin-tls"))
+		viper.BindPFlag("admin.auth.readonly", cmd.Flags().Lookup("admin-readonly"))
+		viper.BindPFlag("admin.auth.readwrite", cmd.Flags().Lookup("admin-readwrite"))
+		viper.BindPFlag("authz.port", cmd.Flags().Lookup("authz-port"))
+		viper.BindPFlag("authz.binding", cmd.Flags().Lookup("authz-binding"))
+		viper.BindPFlag("authz.audiences", cmd.Flags().Lookup("authz-audiences"))
+		viper.BindPFlag("authz.require", cmd.Flags().Lookup("authz-require"))
 		viper.BindPFlag("components", cmd.Flags().Lookup("components"))
+		viper.BindPFlag("housekeeping.interval", cmd.Flags().Lookup("housekeeping-interval"))
+		viper.BindPFlag("audit.file", cmd.Flags().Lookup("audit-file"))
+		viper.BindPFlag("audit.maxSize", cmd.Flags().Lookup("audit-max-size"))
+		viper.BindPFlag("audit.maxBackups", cmd.Flags().Lookup("audit-max-backups"))
+		viper.BindPFlag("audit.webhook", cmd.Flags().Lookup("audit-webhook"))
+		viper.BindPFlag("audit.webhookTimeout", cmd.Flags().Lookup("audit-webhook-timeout"))
 	},
 }
 
@@ -45,6 +73,8 @@ func runStart(cmd *cobra.Command, args []string) error {
 	logger.Info().Msg("starting tailbone server")
 
 	var servers []utils.IServer
+	var issuerSrv *core.IssuerListener
+	var authzSrv *core.AuthzListener
 	components := viper.GetStringSlice("components")
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -65,12 +95,18 @@ func runStart(cmd *cobra.Command, args []string) error {
 		Str("ip", ip.String()).
 		Msg("Tailscale server started")
 
+	auditor, err := core.NewAuditor(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create auditor: %w", err)
+	}
+	defer auditor.Close()
+
 	if slices.Contains(components, "issuer") {
 		if viper.GetString("server.binding") == "auto" {
 			viper.Set("server.binding", ip.String())
 		}
 
-		srv, err := core.NewIssuerListener(tsServer.Server())
+		srv, err := core.NewIssuerListener(tsServer.Server(), auditor)
 		if err != nil {
 			return fmt.Errorf("failed to create issuer listener: %w", err)
 		}
@@ -82,16 +118,42 @@ func runStart(cmd *cobra.Command, args []string) error {
 			}
 		}()
 		servers = append(servers, srv)
+		issuerSrv = srv
+	}
+
+	if slices.Contains(components, "authz") {
+		if viper.GetString("authz.binding") == "auto" {
+			viper.Set("authz.binding", ip.String())
+		}
+		srv, err := core.NewAuthzListener(ctx, tsServer.Server())
+		if err != nil {
+			return fmt.Errorf("failed to create authz listener: %w", err)
+		}
+		go func() {
+			if err := srv.Start(); err != nil {
+				logger.Error().Err(err).Msg("authz listener error")
+				cancel()
+				return
+			}
+		}()
+		servers = append(servers, srv)
+		authzSrv = srv
 	}
 
 	if slices.Contains(components, "admin") {
 		if viper.GetString("admin.binding") == "auto" {
 			viper.Set("admin.binding", ip.String())
 		}
-		adminSrv, err := core.NewAdminListener(ctx, tsServer.Server())
+		adminSrv, err := core.NewAdminListener(ctx, tsServer.Server(), auditor)
 		if err != nil {
 			return fmt.Errorf("failed to create admin listener: %w", err)
 		}
+		if issuerSrv != nil {
+			adminSrv.OnKeysChanged(issuerSrv.ReloadKeys)
+		}
+		if authzSrv != nil {
+			adminSrv.OnKeysChanged(authzSrv.ReloadKeys)
+		}
 		go func() {
 			if err := adminSrv.Start(); err != nil {
 				logger.Error().Err(err).Msg("admin listener error")
@@ -102,6 +164,28 @@ func runStart(cmd *cobra.Command, args []string) error {
 		servers = append(servers, adminSrv)
 	}
 
+	if slices.Contains(components, "housekeeper") {
+		housekeeper, err := core.NewHouseKeeper(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create housekeeper: %w", err)
+		}
+		if issuerSrv != nil {
+			housekeeper.OnKeysChanged(issuerSrv.ReloadKeys)
+			issuerSrv.RegisterStatus("housekeeper", housekeeper)
+		}
+		if authzSrv != nil {
+			housekeeper.OnKeysChanged(authzSrv.ReloadKeys)
+		}
+		go func() {
+			if err := housekeeper.Start(); err != nil {
+				logger.Error().Err(err).Msg("housekeeper error")
+				cancel()
+				return
+			}
+		}()
+		servers = append(servers, housekeeper)
+	}
+
 	utils.WaitForSignal(ctx)
 	logger.Info().Msg("shutting down listeners")
 
@@ -119,16 +203,46 @@ func runStart(cmd *cobra.Command, args []string) error {
 func init() {
 	Cmd.AddCommand(startCmd)
 	// IssuerListener flags
-	startCmd.Flags().IntP("port", "p", 80, "Port to run the server on (issuer)")
+	startCmd.Flags().IntP("port", "p", 0, "Port to run the server on (issuer) (default 80, or 443 with --tls)")
 	startCmd.Flags().StringP("binding", "b", "auto", "Binding address for the server (issuer)")
+	startCmd.Flags().Bool("tls", false, "Serve HTTPS with the Tailscale certificate of the node (issuer)")
 	startCmd.Flags().String("ts-authkey", "", "Tailscale auth key")
 	startCmd.Flags().Duration("ts-join-timeout", 60*time.Second, "Tailscale join timeout")
 	startCmd.Flags().Duration("ts-join-retry", 1*time.Second, "Tailscale join retry interval")
 	startCmd.Flags().String("issuer", "tailbone", "Issuer name for JWT tokens")
 	startCmd.Flags().Duration("expiry", 20*time.Minute, "Token expiry duration")
+	startCmd.Flags().Duration("refresh-expiry", 24*time.Hour, "Refresh token expiry duration")
+	startCmd.Flags().String("refresh-file", "", "File refresh tokens are kept in (default is refresh_tokens.json in the key directory)")
+	startCmd.Flags().String("clients-file", "", "File registered clients are kept in (default is clients.json in the key directory)")
+	startCmd.Flags().StringSlice("exchange-audiences", []string{}, "Callers allowed to exchange tokens for an audience, as audience=principal (token exchange is disabled if empty)")
+	startCmd.Flags().String("oidc-base-url", "", "URL the issuer is reachable at, used for OIDC discovery and DPoP proofs (default is derived from the request)")
+	startCmd.Flags().Duration("x509-expiry", 1*time.Hour, "X.509 client certificate expiry duration")
+	startCmd.Flags().Duration("x509-ca-validity", 365*24*time.Hour, "Validity of newly generated X.509 CA certificates")
+	startCmd.Flags().Duration("ssh-expiry", 1*time.Hour, "SSH user certificate expiry duration")
+	startCmd.Flags().StringSlice("ssh-domains", []string{}, "Login domains whose users also get the local part of their login name as SSH principal")
+	startCmd.Flags().Bool("verify-whois", false, "Identify tailnet clients without a token by WhoIs on the forward-auth endpoint")
+	startCmd.Flags().String("verify-client-ip-header", "X-Forwarded-For", "Header forward-auth proxies pass the client address in")
+	startCmd.Flags().String("kubernetes-audience", "kubernetes", "Audience tokens must be issued for to be accepted by the Kubernetes TokenReview webhook")
+	startCmd.Flags().String("spiffe-trust-domain", "", "Issue JWT-SVIDs in this SPIFFE trust domain")
+	startCmd.Flags().String("spiffe-id-template", core.DefaultSPIFFEIDTemplate, "Template of the SPIFFE ID path of JWT-SVIDs")
 	startCmd.Flags().String("ts-dir", ".tsnet", "Tailscale state directory")
 	startCmd.Flags().String("ts-hostname", "tailbone", "Tailscale hostname")
 	startCmd.Flags().String("admin-binding", "auto", "Admin server binding address")
 	startCmd.Flags().Int("admin-port", 50051, "Admin server port")
-	startCmd.Flags().StringSlice("components", []string{"issuer", "admin"}, "Components to start")
+	startCmd.Flags().Bool("admin-tls", false, "Serve the admin API over TLS with the Tailscale certificate of the node")
+	startCmd.Flags().StringSlice("admin-readonly", []string{}, "Principals with read-only access to the admin API (user:, tag:, cap:)")
+	startCmd.Flags().StringSlice("admin-readwrite", []string{}, "Principals with read-write access to the admin API (user:, tag:, cap:)")
+	startCmd.Flags().StringSlice("components", []string{"issuer", "admin"}, "Components to start (issuer, admin, housekeeper, authz)")
+	startCmd.Flags().Duration("housekeeping-interval", 1*time.Hour, "Interval between housekeeping runs (housekeeper)")
+	// AuthzListener flags
+	startCmd.Flags().Int("authz-port", 9191, "Envoy external authorization server port (authz)")
+	startCmd.Flags().String("authz-binding", "auto", "Envoy external authorization server binding address (authz)")
+	startCmd.Flags().StringSlice("authz-audiences", []string{}, "Audiences tokens must be issued for, one of them is enough (authz)")
+	startCmd.Flags().StringSlice("authz-require", []string{}, "Claim rules tokens must satisfy, as claim=value (authz)")
+	// Audit flags
+	startCmd.Flags().String("audit-file", "", "Path of the audit log file (JSONL)")
+	startCmd.Flags().Int64("audit-max-size", 100, "Maximum size of the audit log file in megabytes before it is rotated")
+	startCmd.Flags().Int("audit-max-backups", 5, "Number of rotated audit log files to keep")
+	startCmd.Flags().String("audit-webhook", "", "URL to POST audit events to")
+	startCmd.Flags().Duration("audit-webhook-timeout", 5*time.Second, "Timeout for audit webhook requests")
 }
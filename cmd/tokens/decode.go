@@ -0,0 +1,139 @@
+package tokens
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+
+	"github.com/altacoda/tailbone/utils"
+)
+
+var decodeCmd = &cobra.Command{
+	Use:   "decode [token]",
+	Short: "Show the header and claims of a token",
+	Long: `Show the header and claims of a token without verifying it.
+The token is read from standard input if it is not given or is "-".`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runDecode,
+}
+
+// timeClaims are shown as times in text output
+var timeClaims = []string{"exp", "iat", "nbf", "auth_time"}
+
+// decodedToken is the output of decode in json and yaml
+type decodedToken struct {
+	Header map[string]interface{} `json:"header" yaml:"header"`
+	Claims jwt.MapClaims          `json:"claims" yaml:"claims"`
+}
+
+func init() {
+	Cmd.AddCommand(decodeCmd)
+}
+
+func runDecode(_ *cobra.Command, args []string) error {
+	tokenString, err := readToken(args)
+	if err != nil {
+		return err
+	}
+
+	decoded, err := decodeToken(tokenString)
+	if err != nil {
+		return err
+	}
+
+	if !utils.IsText() {
+		return utils.Print(decoded)
+	}
+
+	return utils.Print(decoded.outData())
+}
+
+// readToken returns the token given as argument, or read from standard input
+func readToken(args []string) (string, error) {
+	if len(args) > 0 && args[0] != "-" {
+		return strings.TrimSpace(args[0]), nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(os.Stdin, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("failed to read token: %w", err)
+	}
+
+	tokenString := strings.TrimSpace(string(data))
+	if tokenString == "" {
+		return "", fmt.Errorf("no token given")
+	}
+	return tokenString, nil
+}
+
+// decodeToken parses a token without verifying it
+func decodeToken(tokenString string) (*decodedToken, error) {
+	claims := jwt.MapClaims{}
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode token: %w", err)
+	}
+
+	return &decodedToken{Header: token.Header, Claims: claims}, nil
+}
+
+// outData returns the header and claims as table rows
+func (d *decodedToken) outData() utils.OutData {
+	out := utils.OutData{
+		Headers: table.Row{"Part", "Name", "Value"},
+		Rows:    []table.Row{},
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(d.Header)) {
+		out.Rows = append(out.Rows, table.Row{"header", name, formatClaim(name, d.Header[name])})
+	}
+	for _, name := range slices.Sorted(maps.Keys(d.Claims)) {
+		out.Rows = append(out.Rows, table.Row{"claims", name, formatClaim(name, d.Claims[name])})
+	}
+
+	return out
+}
+
+// formatClaim formats a header or claim value for text output
+func formatClaim(name string, value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		if slices.Contains(timeClaims, name) {
+			t := time.Unix(int64(v), 0)
+			return fmt.Sprintf("%s (%s)", utils.GetTimeInUserZone(t), formatRelative(t))
+		}
+		return fmt.Sprint(v)
+	case string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, formatClaim("", item))
+		}
+		return strings.Join(values, ", ")
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	}
+}
+
+// formatRelative describes a time relative to now, e.g. "in 5m0s" or "2m30s ago"
+func formatRelative(t time.Time) string {
+	d := time.Until(t).Truncate(time.Second)
+	if d < 0 {
+		return fmt.Sprintf("%s ago", -d)
+	}
+	return fmt.Sprintf("in %s", d)
+}
@@ -0,0 +1,59 @@
+package tokens
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/altacoda/tailbone/utils"
+)
+
+var getCmd = &cobra.Command{
+	Use:   "get",
+	Short: "Get a token from the issuer",
+	Long: `Get a token for this machine or user from the issuer's /issue endpoint and print it.
+The issuer identifies the caller by its Tailscale address, so this must run on the tailnet.
+With --cache, the token is kept on disk and reused until shortly before it expires.`,
+	Args: cobra.NoArgs,
+	RunE: runGet,
+}
+
+// issuedToken is the output of get in json and yaml
+type issuedToken struct {
+	Token     string    `json:"token" yaml:"token"`
+	TokenType string    `json:"token_type" yaml:"token_type"`
+	ExpiresAt time.Time `json:"expires_at" yaml:"expires_at"`
+}
+
+func init() {
+	Cmd.AddCommand(getCmd)
+
+	utils.AddTokenClientFlags(getCmd)
+	getCmd.Flags().StringSlice("audience", []string{}, "Audience of the token")
+	getCmd.Flags().Bool("cache", false, "Reuse a cached token and cache new ones")
+}
+
+func runGet(cmd *cobra.Command, _ []string) error {
+	ctx := context.Background()
+	audience, _ := cmd.Flags().GetStringSlice("audience")
+	useCache, _ := cmd.Flags().GetBool("cache")
+
+	token, err := utils.GetToken(ctx, audience, useCache)
+	if err != nil {
+		return fmt.Errorf("failed to get token: %w", err)
+	}
+
+	// print the bare token in text mode so it can be used in scripts
+	if utils.IsText() {
+		fmt.Println(token.AccessToken)
+		return nil
+	}
+
+	return utils.Print(issuedToken{
+		Token:     token.AccessToken,
+		TokenType: token.Type(),
+		ExpiresAt: token.Expiry,
+	})
+}
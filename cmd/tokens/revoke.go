@@ -0,0 +1,71 @@
+package tokens
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+
+	"github.com/altacoda/tailbone/proto"
+	"github.com/altacoda/tailbone/utils"
+)
+
+var revokeCmd = &cobra.Command{
+	Use:   "revoke [jti]",
+	Short: "Revoke a token or all tokens of a subject",
+	Long: `Revoke a single token by its ID (jti), or every token issued so far to a subject
+using --subject. Revoked tokens are added to the published revocation list.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runRevoke,
+}
+
+func init() {
+	Cmd.AddCommand(revokeCmd)
+
+	revokeCmd.Flags().String("subject", "", "Revoke all tokens issued to this subject instead of a single token")
+}
+
+func runRevoke(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	subject, _ := cmd.Flags().GetString("subject")
+
+	if (len(args) == 0) == (subject == "") {
+		return fmt.Errorf("either a jti or --subject is required")
+	}
+
+	client, err := utils.NewAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	var revocation *proto.Revocation
+	if subject != "" {
+		resp, err := client.RevokeSubject(ctx, &proto.RevokeSubjectRequest{
+			Sub: subject,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to revoke subject: %w", err)
+		}
+		revocation = resp.Revocation
+	} else {
+		resp, err := client.RevokeToken(ctx, &proto.RevokeTokenRequest{
+			Jti: args[0],
+		})
+		if err != nil {
+			return fmt.Errorf("failed to revoke token: %w", err)
+		}
+		revocation = resp.Revocation
+	}
+
+	out := utils.OutData{
+		Headers: table.Row{"Jti", "Subject", "Revoked", "Expires"},
+		Rows:    []table.Row{},
+	}
+
+	out.Rows = append(out.Rows, table.Row{revocation.Jti, revocation.Sub, time.Unix(revocation.RevokedAt, 0).Format(time.RFC3339), time.Unix(revocation.ExpiresAt, 0).Format(time.RFC3339)})
+	out.RawData = append(out.RawData, revocation)
+
+	return utils.Print(out)
+}
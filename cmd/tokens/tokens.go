@@ -0,0 +1,19 @@
+package tokens
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/altacoda/tailbone/utils"
+)
+
+var Cmd = &cobra.Command{
+	Use:     "tokens",
+	Aliases: []string{"token"},
+	Short:   "Token management commands",
+	Long: `Token management commands for the Tailbone identity server.
+These commands allow you to get, inspect, verify and revoke tokens.`,
+}
+
+func init() {
+	utils.AddAdminClientFlags(Cmd)
+}
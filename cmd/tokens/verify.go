@@ -0,0 +1,176 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/cobra"
+
+	"github.com/altacoda/tailbone/utils"
+	"github.com/altacoda/tailbone/verifier"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [token]",
+	Short: "Verify a token against a JWKS",
+	Long: `Verify the signature and claims of a token against a JWKS, fetched from a URL or read
+from a local file, and explain why verification failed. The token is read from standard
+input if it is not given or is "-".`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runVerify,
+}
+
+// verification is the output of verify in json and yaml
+type verification struct {
+	Valid  bool                   `json:"valid" yaml:"valid"`
+	Reason string                 `json:"reason,omitempty" yaml:"reason,omitempty"`
+	Error  string                 `json:"error,omitempty" yaml:"error,omitempty"`
+	Header map[string]interface{} `json:"header,omitempty" yaml:"header,omitempty"`
+	Claims jwt.MapClaims          `json:"claims,omitempty" yaml:"claims,omitempty"`
+}
+
+func init() {
+	Cmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().String("jwks", "", "URL or file of the JWKS (default is http://<host>/.well-known/jwks.json, or https with --tls)")
+	verifyCmd.Flags().String("issuer", verifier.DefaultIssuer, "Expected issuer of the token")
+	verifyCmd.Flags().StringSlice("audience", []string{}, "Audiences the token must be issued for, one of them is enough")
+	verifyCmd.Flags().Duration("leeway", verifier.DefaultLeeway, "Clock skew tolerated when checking exp, nbf and iat")
+}
+
+func runVerify(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	jwks, _ := cmd.Flags().GetString("jwks")
+	issuer, _ := cmd.Flags().GetString("issuer")
+	audience, _ := cmd.Flags().GetStringSlice("audience")
+	leeway, _ := cmd.Flags().GetDuration("leeway")
+
+	tokenString, err := readToken(args)
+	if err != nil {
+		return err
+	}
+
+	jwksURL, httpClient, err := jwksSource(jwks)
+	if err != nil {
+		return err
+	}
+
+	result := verification{}
+	if decoded, err := decodeToken(tokenString); err == nil {
+		result.Header = decoded.Header
+		result.Claims = decoded.Claims
+	}
+
+	v, err := verifier.New(ctx, verifier.Config{
+		JWKSURL:    jwksURL,
+		Issuer:     issuer,
+		Audiences:  audience,
+		Leeway:     leeway,
+		HTTPClient: httpClient,
+	})
+	if err == nil {
+		defer v.Close()
+		_, err = v.Verify(ctx, tokenString)
+	}
+
+	if err != nil {
+		result.Reason = explainVerifyError(err, &result, jwksURL, issuer, audience, leeway)
+		result.Error = err.Error()
+	} else {
+		result.Valid = true
+	}
+
+	if !utils.IsText() {
+		if err := utils.Print(result); err != nil {
+			return err
+		}
+	} else if result.Valid {
+		utils.PrintInfo("Token is valid\n")
+		decoded := decodedToken{Header: result.Header, Claims: result.Claims}
+		if err := utils.Print(decoded.outData()); err != nil {
+			return err
+		}
+	}
+
+	if !result.Valid {
+		return fmt.Errorf("token verification failed: %s: %w", result.Reason, err)
+	}
+
+	return nil
+}
+
+// jwksSource returns the URL of the JWKS and the client to fetch it with. Local files are
+// fetched with a file:// URL
+func jwksSource(jwks string) (string, *http.Client, error) {
+	if jwks == "" {
+		issuerURL, err := utils.HostIssuerURL()
+		if err != nil {
+			return "", nil, fmt.Errorf("JWKS is not set, use --jwks or --host")
+		}
+		return issuerURL + "/.well-known/jwks.json", http.DefaultClient, nil
+	}
+
+	if strings.HasPrefix(jwks, "http://") || strings.HasPrefix(jwks, "https://") {
+		return jwks, http.DefaultClient, nil
+	}
+
+	path, err := filepath.Abs(jwks)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve JWKS path: %w", err)
+	}
+
+	transport := &http.Transport{}
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	return "file://" + filepath.ToSlash(path), &http.Client{Transport: transport}, nil
+}
+
+// explainVerifyError describes why a token failed verification in terms of its header and claims
+func explainVerifyError(err error, result *verification, jwksURL, issuer string, audience []string, leeway time.Duration) string {
+	header := func(name string) string {
+		value, _ := result.Header[name].(string)
+		return value
+	}
+	claimTime := func(name string) string {
+		return formatClaim(name, result.Claims[name])
+	}
+
+	switch {
+	case errors.Is(err, verifier.ErrKeySetUnavailable):
+		return fmt.Sprintf("the JWKS could not be loaded from %s", jwksURL)
+	case errors.Is(err, verifier.ErrMalformedToken):
+		return "the token is not a well-formed JWT"
+	case errors.Is(err, verifier.ErrUnknownKey):
+		if header("kid") == "" {
+			return "the token header has no key ID (kid)"
+		}
+		return fmt.Sprintf("the key %q the token is signed with is not in the JWKS, it may have been removed by key rotation or the token was issued by another server", header("kid"))
+	case errors.Is(err, verifier.ErrInvalidSignature):
+		if alg := header("alg"); alg != jwt.SigningMethodRS256.Alg() {
+			return fmt.Sprintf("the token is signed with %s, only %s is accepted", alg, jwt.SigningMethodRS256.Alg())
+		}
+		return fmt.Sprintf("the signature does not match the key %q, the token was modified or signed with another key", header("kid"))
+	case errors.Is(err, verifier.ErrTokenExpired):
+		return fmt.Sprintf("the token expired at %s, %s of clock skew are tolerated", claimTime("exp"), leeway)
+	case errors.Is(err, verifier.ErrTokenNotYetValid):
+		if nbf, ok := result.Claims["nbf"].(float64); ok && time.Until(time.Unix(int64(nbf), 0)) > leeway {
+			return fmt.Sprintf("the token is not valid before %s, %s of clock skew are tolerated", claimTime("nbf"), leeway)
+		}
+		return fmt.Sprintf("the token was issued in the future at %s, %s of clock skew are tolerated", claimTime("iat"), leeway)
+	case errors.Is(err, verifier.ErrInvalidIssuer):
+		return fmt.Sprintf("the token is issued by %q, expected %q", result.Claims["iss"], issuer)
+	case errors.Is(err, verifier.ErrInvalidAudience):
+		aud := formatClaim("aud", result.Claims["aud"])
+		if aud == "" || aud == "null" {
+			return fmt.Sprintf("the token has no audience, expected one of %s", strings.Join(audience, ", "))
+		}
+		return fmt.Sprintf("the token is issued for %s, expected one of %s", aud, strings.Join(audience, ", "))
+	default:
+		return "the token is invalid"
+	}
+}
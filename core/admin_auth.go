@@ -0,0 +1,205 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"tailscale.com/client/tailscale"
+
+	"github.com/altacoda/tailbone/utils"
+)
+
+// AdminRole is the level of access a caller has to the admin API
+type AdminRole int
+
+const (
+	AdminRoleNone AdminRole = iota
+	AdminRoleReadOnly
+	AdminRoleReadWrite
+)
+
+func (r AdminRole) String() string {
+	switch r {
+	case AdminRoleReadOnly:
+		return "readonly"
+	case AdminRoleReadWrite:
+		return "readwrite"
+	default:
+		return "none"
+	}
+}
+
+// adminMethodRoles holds the role required by each admin RPC. Methods not listed require AdminRoleReadWrite
+var adminMethodRoles = map[string]AdminRole{
+	"/proto.AdminService/GenerateNewKeys": AdminRoleReadWrite,
+	"/proto.AdminService/ListKeys":        AdminRoleReadOnly,
+	"/proto.AdminService/RemoveKey":       AdminRoleReadWrite,
+	"/proto.AdminService/VerifyKeys":      AdminRoleReadOnly,
+	"/proto.AdminService/TailAudit":       AdminRoleReadOnly,
+	"/proto.AdminService/ListClients":     AdminRoleReadOnly,
+}
+
+// AdminAuthorizer identifies admin API callers with Tailscale WhoIs and enforces their roles
+type AdminAuthorizer struct {
+	client    *tailscale.LocalClient
+	auditor   Auditor
+	readOnly  []string
+	readWrite []string
+	logger    zerolog.Logger
+}
+
+// NewAdminAuthorizer creates an authorizer with the role lists from the configuration
+func NewAdminAuthorizer(client *tailscale.LocalClient, auditor Auditor) *AdminAuthorizer {
+	a := &AdminAuthorizer{
+		client:    client,
+		auditor:   auditor,
+		readOnly:  viper.GetStringSlice("admin.auth.readonly"),
+		readWrite: viper.GetStringSlice("admin.auth.readwrite"),
+		logger:    utils.GetLogger("admin-auth"),
+	}
+
+	if !a.enforced() {
+		a.logger.Warn().Msg("no admin roles configured. admin API is open to the entire tailnet")
+	}
+
+	return a
+}
+
+// UnaryInterceptor returns a gRPC interceptor that authorizes unary calls
+func (a *AdminAuthorizer) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := a.authorize(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor returns a gRPC interceptor that authorizes streaming calls
+func (a *AdminAuthorizer) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authorize(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &authorizedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func (a *AdminAuthorizer) authorize(ctx context.Context, method string) (context.Context, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		a.logger.Error().Str("method", method).Msg("no peer information in request")
+		return nil, status.Error(codes.Unauthenticated, "unknown caller")
+	}
+
+	who, err := a.client.WhoIs(ctx, p.Addr.String())
+	if err != nil {
+		a.logger.Error().Err(err).Str("addr", p.Addr.String()).Str("method", method).Msg("failed to identify caller")
+		return nil, status.Error(codes.Unauthenticated, "failed to identify caller")
+	}
+
+	identity := NewCallerIdentity(p.Addr.String(), who)
+	logger := a.logger.With().
+		Str("user", identity.LoginName).
+		Str("node", identity.NodeName).
+		Str("method", method).
+		Logger()
+
+	required, ok := adminMethodRoles[method]
+	if !ok {
+		required = AdminRoleReadWrite
+	}
+
+	role := a.roleOf(identity)
+	if role < required {
+		logger.Warn().
+			Str("role", role.String()).
+			Str("required", required.String()).
+			Msg("permission denied")
+		a.auditor.Record(ctx, AuditEvent{
+			Action:  adminAuditAction(method),
+			Actor:   identity,
+			Outcome: AuditOutcomeDenied,
+			Error:   fmt.Sprintf("requires the %s role", required),
+		})
+		return nil, status.Errorf(codes.PermissionDenied, "%s requires the %s role", path.Base(method), required)
+	}
+
+	logger.Debug().Str("role", role.String()).Msg("authorized admin call")
+	return WithCallerIdentity(ctx, identity), nil
+}
+
+// roleOf returns the highest role granted to the caller
+func (a *AdminAuthorizer) roleOf(identity *CallerIdentity) AdminRole {
+	if !a.enforced() {
+		return AdminRoleReadWrite
+	}
+
+	if matchesAnyPrincipal(identity, a.readWrite) {
+		return AdminRoleReadWrite
+	}
+
+	if matchesAnyPrincipal(identity, a.readOnly) {
+		return AdminRoleReadOnly
+	}
+
+	return AdminRoleNone
+}
+
+func (a *AdminAuthorizer) enforced() bool {
+	return len(a.readOnly) > 0 || len(a.readWrite) > 0
+}
+
+// matchesAnyPrincipal checks the caller against principals of the form
+// user:<login>, user:*@<domain>, tag:<tag> and cap:<capability>
+func matchesAnyPrincipal(identity *CallerIdentity, principals []string) bool {
+	for _, principal := range principals {
+		kind, value, found := strings.Cut(principal, ":")
+		if !found {
+			continue
+		}
+
+		switch kind {
+		case "user":
+			if value == identity.LoginName {
+				return true
+			}
+			if domain, ok := strings.CutPrefix(value, "*@"); ok && strings.HasSuffix(identity.LoginName, "@"+domain) {
+				return true
+			}
+		case "tag":
+			if slices.Contains(identity.Tags, principal) {
+				return true
+			}
+		case "cap":
+			if slices.Contains(identity.Capabilities, value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// authorizedStream carries the caller identity in the context of a server stream
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
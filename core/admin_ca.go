@@ -0,0 +1,171 @@
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/spf13/viper"
+
+	"github.com/altacoda/tailbone/proto"
+	"github.com/altacoda/tailbone/utils"
+)
+
+// generateCAKey creates a new key of a certificate authority and publishes the updated CA bundle
+func (s *AdminListener) generateCAKey(ctx context.Context, keyType utils.KeyType) (*proto.GenerateNewKeysResponse, error) {
+	s.logger.Info().Str("type", string(keyType)).Msg("generating new CA key")
+	storage := utils.NewCAStorage(keyType)
+
+	key, err := storage.GenerateKey(ctx)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to generate CA key")
+		return nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+
+	resp := &proto.GenerateNewKeysResponse{
+		Key: caKeyToProto(keyType, key),
+	}
+
+	switch keyType {
+	case utils.KeyTypeX509CA:
+		cert, err := utils.NewX509CACertificate(ctx, storage, key, viper.GetDuration("x509.caValidity"))
+		if err != nil {
+			s.logger.Error().Err(err).Msg("failed to create CA certificate")
+			// without a certificate the key is of no use
+			storage.DeleteKey(ctx, key.KeyID())
+			return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+		}
+		resp.Key.ExpiresAt = cert.NotAfter.Unix()
+	}
+
+	if err := s.publishCABundle(ctx, keyType); err != nil {
+		return nil, err
+	}
+
+	s.logger.Info().Str("type", string(keyType)).Str("key_id", key.KeyID()).Msg("successfully generated CA key")
+	return resp, nil
+}
+
+// listCAKeys lists the keys of a certificate authority
+func (s *AdminListener) listCAKeys(ctx context.Context, keyType utils.KeyType) ([]*proto.Key, error) {
+	storage := utils.NewCAStorage(keyType)
+
+	var keys []*proto.Key
+	switch keyType {
+	case utils.KeyTypeX509CA:
+		cas, err := utils.LoadX509CAs(ctx, storage)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("failed to load CA keys")
+			return nil, fmt.Errorf("failed to load CA keys: %w", err)
+		}
+		for _, ca := range cas {
+			key := &proto.Key{
+				KeyId:     ca.KeyID,
+				Algorithm: ca.Certificate.SignatureAlgorithm.String(),
+				CreatedAt: ca.Certificate.NotBefore.Unix(),
+				Type:      string(keyType),
+				ExpiresAt: ca.Certificate.NotAfter.Unix(),
+			}
+			if ts, err := utils.ParseCreatedAt(ca.KeyID); err == nil {
+				key.CreatedAt = ts.Unix()
+			}
+			keys = append(keys, key)
+		}
+	case utils.KeyTypeSSHCA:
+		cas, err := utils.LoadSSHCAs(ctx, storage)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("failed to load CA keys")
+			return nil, fmt.Errorf("failed to load CA keys: %w", err)
+		}
+		for _, ca := range cas {
+			key := &proto.Key{
+				KeyId:     ca.KeyID,
+				Algorithm: ca.Signer.PublicKey().Type(),
+				Type:      string(keyType),
+			}
+			if ts, err := utils.ParseCreatedAt(ca.KeyID); err == nil {
+				key.CreatedAt = ts.Unix()
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// removeCAKey deletes a key of a certificate authority and publishes the updated CA bundle
+func (s *AdminListener) removeCAKey(ctx context.Context, keyType utils.KeyType, kid string) (*proto.RemoveKeyResponse, error) {
+	s.logger.Info().Str("type", string(keyType)).Str("key_id", kid).Msg("removing CA key")
+
+	if err := utils.NewCAStorage(keyType).DeleteKey(ctx, kid); err != nil {
+		s.logger.Error().Err(err).Msg("failed to remove CA key")
+		return nil, fmt.Errorf("failed to remove CA key: %w", err)
+	}
+
+	if err := s.publishCABundle(ctx, keyType); err != nil {
+		return nil, err
+	}
+
+	keys, err := s.listCAKeys(ctx, keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info().Str("type", string(keyType)).Str("key_id", kid).Msg("successfully removed CA key")
+	return &proto.RemoveKeyResponse{
+		Keys: keys,
+	}, nil
+}
+
+// publishCABundle uploads the public part of a certificate authority next to the JWKS,
+// so relying parties can trust the certificates it issues
+func (s *AdminListener) publishCABundle(ctx context.Context, keyType utils.KeyType) error {
+	var data []byte
+	var keyPath string
+	var err error
+
+	switch keyType {
+	case utils.KeyTypeX509CA:
+		keyPath = viper.GetString("x509.bundlePath")
+		data, err = utils.X509CABundle(ctx, utils.NewCAStorage(keyType))
+	case utils.KeyTypeSSHCA:
+		keyPath = viper.GetString("ssh.caPath")
+		data, err = utils.SSHCAPublicKeys(ctx, utils.NewCAStorage(keyType))
+	default:
+		return fmt.Errorf("key type %s has no CA bundle", keyType)
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to build CA bundle")
+		return fmt.Errorf("failed to build CA bundle: %w", err)
+	}
+
+	bucket, _, err := s.cloudConnector.GetBucketAndKeyPath(ctx)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to get bucket and key path")
+		return fmt.Errorf("failed to get bucket and key path: %w", err)
+	}
+
+	if err := s.cloudConnector.Upload(ctx, bucket, keyPath, data); err != nil {
+		s.logger.Error().Err(err).Msg("failed to upload CA bundle")
+		return fmt.Errorf("failed to upload CA bundle: %w", err)
+	}
+
+	s.logger.Info().
+		Str("type", string(keyType)).
+		Str("bucket", bucket).
+		Str("key_path", keyPath).
+		Msg("published CA bundle")
+	return nil
+}
+
+func caKeyToProto(keyType utils.KeyType, key jwk.Key) *proto.Key {
+	protoKey := &proto.Key{
+		KeyId:     key.KeyID(),
+		Algorithm: key.Algorithm().String(),
+		Type:      string(keyType),
+	}
+	if ts, err := utils.ParseCreatedAt(key.KeyID()); err == nil {
+		protoKey.CreatedAt = ts.Unix()
+	}
+	return protoKey
+}
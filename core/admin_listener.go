@@ -2,31 +2,45 @@ package core
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"path"
 
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/rs/zerolog"
 	"github.com/spf13/viper"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 	"tailscale.com/tsnet"
 
 	"github.com/altacoda/tailbone/proto"
 	"github.com/altacoda/tailbone/utils"
 )
 
+// errHTTPSDisabled is returned when TLS is enabled but the tailnet does not issue certificates
+var errHTTPSDisabled = errors.New("HTTPS is not enabled for the tailnet, see https://tailscale.com/s/https")
+
 // AdminListener implements the AdminServiceServer interface
 type AdminListener struct {
 	proto.UnimplementedAdminServiceServer
 	server          *tsnet.Server
 	cloudConnector  utils.CloudConnector
 	localKeyStorage utils.ILocalKeyStorage
+	auditor         Auditor
+	revocations     *RevocationStore
+	clients         *ClientRegistry
 	grpcServer      *grpc.Server
 	logger          zerolog.Logger
 	done            chan struct{}
+	onKeysChanged   []func(ctx context.Context) error
 }
 
 // NewAdminListener creates a new instance of AdminListener
-func NewAdminListener(ctx context.Context, tsServer *tsnet.Server) (*AdminListener, error) {
+func NewAdminListener(ctx context.Context, tsServer *tsnet.Server, auditor Auditor) (*AdminListener, error) {
 	// Configure logger
 	logger := utils.GetLogger("admin-listener")
 	logger.Info().Msg("initializing admin listener")
@@ -39,10 +53,42 @@ func NewAdminListener(ctx context.Context, tsServer *tsnet.Server) (*AdminListen
 
 	localKeyStorage := utils.NewLocalKeyStorage()
 
+	clients, err := NewClientRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := tsServer.LocalClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local client: %w", err)
+	}
+
+	authorizer := NewAdminAuthorizer(client, auditor)
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(authorizer.UnaryInterceptor(), auditInterceptor(auditor)),
+		grpc.StreamInterceptor(authorizer.StreamInterceptor()),
+	}
+
+	if viper.GetBool("admin.tls") {
+		if len(tsServer.CertDomains()) == 0 {
+			return nil, errHTTPSDisabled
+		}
+
+		// the certificate for the MagicDNS name of the node is fetched from Tailscale on first use
+		opts = append(opts, grpc.Creds(credentials.NewTLS(&tls.Config{
+			GetCertificate: client.GetCertificate,
+		})))
+	}
+
+	grpcServer := grpc.NewServer(opts...)
+
 	return &AdminListener{
 		cloudConnector:  cloudConnector,
 		localKeyStorage: localKeyStorage,
-		grpcServer:      grpc.NewServer(),
+		auditor:         auditor,
+		revocations:     NewRevocationStore(),
+		clients:         clients,
+		grpcServer:      grpcServer,
 		logger:          logger,
 		server:          tsServer,
 		done:            make(chan struct{}),
@@ -58,6 +104,7 @@ func (s *AdminListener) Start() error {
 	s.logger.Info().
 		Str("binding", binding).
 		Int("port", port).
+		Bool("tls", viper.GetBool("admin.tls")).
 		Msg("creating admin listener")
 
 	lis, err := s.server.Listen("tcp", fmt.Sprintf("%s:%d", binding, port))
@@ -85,8 +132,31 @@ func (s *AdminListener) Stop() {
 	close(s.done)
 }
 
+// OnKeysChanged registers a callback that is called when an admin call changes the local key set.
+// Callbacks must be registered before Start
+func (s *AdminListener) OnKeysChanged(fn func(ctx context.Context) error) {
+	s.onKeysChanged = append(s.onKeysChanged, fn)
+}
+
+// notifyKeysChanged lets the components of this process pick up the changed key set
+func (s *AdminListener) notifyKeysChanged(ctx context.Context) {
+	for _, fn := range s.onKeysChanged {
+		if err := fn(ctx); err != nil {
+			s.logger.Error().Err(err).Msg("failed to notify key set change")
+		}
+	}
+}
+
 // GenerateNewKeys implements the GenerateNewKeys RPC method
 func (s *AdminListener) GenerateNewKeys(ctx context.Context, req *proto.GenerateNewKeysRequest) (*proto.GenerateNewKeysResponse, error) {
+	keyType, err := utils.ParseKeyType(req.Type)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%s", err)
+	}
+	if keyType != utils.KeyTypeJWT {
+		return s.generateCAKey(ctx, keyType)
+	}
+
 	s.logger.Info().Msg("generating new key pair")
 	tokenGenerator := utils.NewKeyManager(s.cloudConnector, s.localKeyStorage)
 
@@ -103,6 +173,9 @@ func (s *AdminListener) GenerateNewKeys(ctx context.Context, req *proto.Generate
 		return nil, err
 	}
 
+	// the issuer signs with the new key right away, so it must also verify with it
+	s.notifyKeysChanged(ctx)
+
 	// Get bucket and key path for upload
 	bucket, keyPath, err := s.cloudConnector.GetBucketAndKeyPath(ctx)
 	if err != nil {
@@ -154,13 +227,27 @@ func (s *AdminListener) GenerateNewKeys(ctx context.Context, req *proto.Generate
 			KeyId:     keyPair.KeyID,
 			Algorithm: keyPair.PublicKey.Algorithm().String(),
 			CreatedAt: keyPair.CreatedAt().Unix(),
+			Type:      string(utils.KeyTypeJWT),
 		},
 	}, nil
 }
 
 // ListKeys implements the ListKeys RPC method
 func (s *AdminListener) ListKeys(ctx context.Context, req *proto.ListKeysRequest) (*proto.ListKeysResponse, error) {
-	s.logger.Info().Msg("listing keys")
+	keyType, err := utils.ParseKeyType(req.Type)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%s", err)
+	}
+
+	s.logger.Info().Str("type", string(keyType)).Msg("listing keys")
+	if keyType != utils.KeyTypeJWT {
+		keys, err := s.listCAKeys(ctx, keyType)
+		if err != nil {
+			return nil, err
+		}
+		return &proto.ListKeysResponse{Keys: keys}, nil
+	}
+
 	return s.listRemoteKeys(ctx)
 }
 
@@ -190,7 +277,7 @@ func (s *AdminListener) listRemoteKeys(ctx context.Context) (*proto.ListKeysResp
 	var keys []*proto.Key
 
 	for _, key := range jwks.Keys {
-		keyInfo := &proto.Key{}
+		keyInfo := &proto.Key{Type: string(utils.KeyTypeJWT)}
 
 		// Extract key metadata
 		if kid, ok := key.Get(jwk.KeyIDKey); ok {
@@ -216,6 +303,14 @@ func (s *AdminListener) listRemoteKeys(ctx context.Context) (*proto.ListKeysResp
 
 // RemoveKey implements the RemoveKey RPC method
 func (s *AdminListener) RemoveKey(ctx context.Context, req *proto.RemoveKeyRequest) (*proto.RemoveKeyResponse, error) {
+	keyType, err := utils.ParseKeyType(req.Type)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%s", err)
+	}
+	if keyType != utils.KeyTypeJWT {
+		return s.removeCAKey(ctx, keyType, req.KeyId)
+	}
+
 	s.logger.Info().Str("key_id", req.KeyId).Msg("removing key")
 	tokenGenerator := utils.NewKeyManager(s.cloudConnector, s.localKeyStorage)
 	localKeyStorage := utils.NewLocalKeyStorage()
@@ -251,12 +346,13 @@ func (s *AdminListener) RemoveKey(ctx context.Context, req *proto.RemoveKeyReque
 		s.logger.Error().Err(err).Msg("failed to remove key from local storage")
 		return nil, fmt.Errorf("failed to remove key from local storage: %w", err)
 	}
+	s.notifyKeysChanged(ctx)
 
 	s.logger.Info().Str("key_id", req.KeyId).Msg("successfully removed key")
 
 	var keys []*proto.Key
 	for _, key := range updatedJWKS.Keys {
-		keyInfo := &proto.Key{}
+		keyInfo := &proto.Key{Type: string(utils.KeyTypeJWT)}
 
 		// Extract key metadata
 		if kid, ok := key.Get(jwk.KeyIDKey); ok {
@@ -279,4 +375,262 @@ func (s *AdminListener) RemoveKey(ctx context.Context, req *proto.RemoveKeyReque
 	}, nil
 }
 
+// VerifyKeys implements the VerifyKeys RPC method
+func (s *AdminListener) VerifyKeys(ctx context.Context, req *proto.VerifyKeysRequest) (*proto.VerifyKeysResponse, error) {
+	s.logger.Info().Msg("verifying keys")
+	tokenGenerator := utils.NewKeyManager(s.cloudConnector, s.localKeyStorage)
+
+	bucket, keyPath, err := s.cloudConnector.GetBucketAndKeyPath(ctx)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to get bucket and key path")
+		return nil, fmt.Errorf("failed to get bucket and key path: %w", err)
+	}
+
+	jwks, err := tokenGenerator.DownloadJWKS(ctx, bucket, keyPath)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to download JWKS")
+		return nil, fmt.Errorf("failed to download JWKS: %w", err)
+	}
+
+	checks, err := s.localKeyStorage.VerifyLocalJWKs(ctx, jwks)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to verify local keys")
+		return nil, fmt.Errorf("failed to verify local keys: %w", err)
+	}
+
+	resp := &proto.VerifyKeysResponse{}
+	for _, check := range checks {
+		resp.Checks = append(resp.Checks, &proto.KeyCheck{
+			KeyId:  check.KeyID,
+			Status: string(check.Status),
+			Detail: check.Detail,
+		})
+	}
+
+	s.logger.Info().Int("key_count", len(checks)).Msg("successfully verified keys")
+	return resp, nil
+}
+
+// TailAudit implements the TailAudit RPC method
+func (s *AdminListener) TailAudit(ctx context.Context, req *proto.TailAuditRequest) (*proto.TailAuditResponse, error) {
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = 20
+	}
+
+	s.logger.Info().Int("limit", limit).Msg("tailing audit log")
+
+	events, err := s.auditor.Tail(ctx, limit)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to read audit log")
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to read audit log: %s", err)
+	}
+
+	resp := &proto.TailAuditResponse{}
+	for _, event := range events {
+		auditEvent := &proto.AuditEvent{
+			Time:     event.Time.Unix(),
+			Action:   event.Action,
+			Kid:      event.KeyID,
+			Audience: event.Audience,
+			Jti:      event.TokenID,
+			Sub:      event.Subject,
+			Outcome:  event.Outcome,
+			Error:    event.Error,
+		}
+		if event.Actor != nil {
+			auditEvent.Actor = event.Actor.LoginName
+			auditEvent.ActorNode = event.Actor.NodeName
+			auditEvent.ActorTags = event.Actor.Tags
+		}
+		resp.Events = append(resp.Events, auditEvent)
+	}
+
+	return resp, nil
+}
+
+// RevokeToken implements the RevokeToken RPC method
+func (s *AdminListener) RevokeToken(ctx context.Context, req *proto.RevokeTokenRequest) (*proto.RevokeTokenResponse, error) {
+	s.logger.Info().Str("jti", req.Jti).Msg("revoking token")
+
+	revoked, list, err := s.revocations.RevokeToken(ctx, req.Jti)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to revoke token")
+		return nil, fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	if err := s.publishRevocations(ctx, list); err != nil {
+		return nil, err
+	}
+
+	s.logger.Info().Str("jti", req.Jti).Msg("successfully revoked token")
+	return &proto.RevokeTokenResponse{
+		Revocation: &proto.Revocation{
+			Jti:       revoked.ID,
+			RevokedAt: revoked.RevokedAt,
+			ExpiresAt: revoked.ExpiresAt,
+		},
+	}, nil
+}
+
+// RevokeSubject implements the RevokeSubject RPC method
+func (s *AdminListener) RevokeSubject(ctx context.Context, req *proto.RevokeSubjectRequest) (*proto.RevokeSubjectResponse, error) {
+	s.logger.Info().Str("sub", req.Sub).Msg("revoking subject")
+
+	revoked, list, err := s.revocations.RevokeSubject(ctx, req.Sub)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to revoke subject")
+		return nil, fmt.Errorf("failed to revoke subject: %w", err)
+	}
+
+	if err := s.publishRevocations(ctx, list); err != nil {
+		return nil, err
+	}
+
+	s.logger.Info().Str("sub", req.Sub).Msg("successfully revoked subject")
+	return &proto.RevokeSubjectResponse{
+		Revocation: &proto.Revocation{
+			Sub:       revoked.Subject,
+			RevokedAt: revoked.RevokedAt,
+			ExpiresAt: revoked.ExpiresAt,
+		},
+	}, nil
+}
+
+// RegisterClient implements the RegisterClient RPC method
+func (s *AdminListener) RegisterClient(ctx context.Context, req *proto.RegisterClientRequest) (*proto.RegisterClientResponse, error) {
+	s.logger.Info().Str("client_id", req.ClientId).Msg("registering client")
+
+	secret, client, err := s.clients.Register(ctx, Client{
+		ID:           req.ClientId,
+		RedirectURIs: req.RedirectUris,
+		Audiences:    req.Audiences,
+		GrantTypes:   req.GrantTypes,
+	}, req.Public)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to register client")
+		if errors.Is(err, ErrClientExists) {
+			return nil, status.Errorf(codes.AlreadyExists, "failed to register client: %s", err)
+		}
+		return nil, fmt.Errorf("failed to register client: %w", err)
+	}
+
+	s.logger.Info().Str("client_id", client.ID).Msg("successfully registered client")
+	return &proto.RegisterClientResponse{
+		Client:       clientToProto(client),
+		ClientSecret: secret,
+	}, nil
+}
+
+// ListClients implements the ListClients RPC method
+func (s *AdminListener) ListClients(ctx context.Context, req *proto.ListClientsRequest) (*proto.ListClientsResponse, error) {
+	s.logger.Info().Msg("listing clients")
+
+	clients, err := s.clients.List(ctx)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to list clients")
+		return nil, fmt.Errorf("failed to list clients: %w", err)
+	}
+
+	resp := &proto.ListClientsResponse{}
+	for _, client := range clients {
+		resp.Clients = append(resp.Clients, clientToProto(&client))
+	}
+
+	return resp, nil
+}
+
+// DeleteClient implements the DeleteClient RPC method
+func (s *AdminListener) DeleteClient(ctx context.Context, req *proto.DeleteClientRequest) (*proto.DeleteClientResponse, error) {
+	s.logger.Info().Str("client_id", req.ClientId).Msg("deleting client")
+
+	if err := s.clients.Delete(ctx, req.ClientId); err != nil {
+		s.logger.Error().Err(err).Msg("failed to delete client")
+		if errors.Is(err, ErrClientNotFound) {
+			return nil, status.Errorf(codes.NotFound, "failed to delete client: %s", err)
+		}
+		if errors.Is(err, ErrClientReadOnly) {
+			return nil, status.Errorf(codes.FailedPrecondition, "failed to delete client: %s", err)
+		}
+		return nil, fmt.Errorf("failed to delete client: %w", err)
+	}
+
+	s.logger.Info().Str("client_id", req.ClientId).Msg("successfully deleted client")
+	return &proto.DeleteClientResponse{}, nil
+}
+
+func clientToProto(client *Client) *proto.Client {
+	return &proto.Client{
+		ClientId:     client.ID,
+		RedirectUris: client.RedirectURIs,
+		Audiences:    client.Audiences,
+		GrantTypes:   client.GrantTypes,
+		Public:       client.Public(),
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+// publishRevocations uploads the revocation list next to the JWKS
+func (s *AdminListener) publishRevocations(ctx context.Context, list *RevocationList) error {
+	bucket, _, err := s.cloudConnector.GetBucketAndKeyPath(ctx)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to get bucket and key path")
+		return fmt.Errorf("failed to get bucket and key path: %w", err)
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return fmt.Errorf("failed to marshal revocation list: %w", err)
+	}
+
+	keyPath := viper.GetString("revocations.keyPath")
+	if err := s.cloudConnector.Upload(ctx, bucket, keyPath, data); err != nil {
+		s.logger.Error().Err(err).Msg("failed to upload revocation list")
+		return fmt.Errorf("failed to upload revocation list: %w", err)
+	}
+
+	s.logger.Info().
+		Str("bucket", bucket).
+		Str("key_path", keyPath).
+		Int("tokens", len(list.Tokens)).
+		Int("subjects", len(list.Subjects)).
+		Msg("published revocation list")
+	return nil
+}
+
+// auditInterceptor records every admin call in the audit log
+func auditInterceptor(auditor Auditor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+
+		event := AuditEvent{Action: adminAuditAction(info.FullMethod)}
+		if r, ok := req.(interface{ GetKeyId() string }); ok {
+			event.KeyID = r.GetKeyId()
+		}
+		if r, ok := req.(interface{ GetJti() string }); ok {
+			event.TokenID = r.GetJti()
+		}
+		if r, ok := req.(interface{ GetSub() string }); ok {
+			event.Subject = r.GetSub()
+		}
+		if r, ok := req.(interface{ GetClientId() string }); ok {
+			event.Subject = r.GetClientId()
+		}
+		switch r := resp.(type) {
+		case *proto.GenerateNewKeysResponse:
+			event.KeyID = r.GetKey().GetKeyId()
+		case *proto.RegisterClientResponse:
+			event.Subject = r.GetClient().GetClientId()
+		}
+
+		auditor.Record(ctx, event.WithResult(err))
+		return resp, err
+	}
+}
+
+// adminAuditAction returns the audit action name of an admin RPC
+func adminAuditAction(method string) string {
+	return "admin." + path.Base(method)
+}
+
 var _ utils.IServer = &AdminListener{}
@@ -0,0 +1,355 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+
+	"github.com/altacoda/tailbone/client"
+	"github.com/altacoda/tailbone/utils"
+)
+
+// agentRetryInterval is how long the agent waits before retrying a failed first fetch of a token
+const agentRetryInterval = 10 * time.Second
+
+// AgentSink is a file the token for an audience is written to whenever it is refreshed
+type AgentSink struct {
+	Audience []string
+	Path     string
+}
+
+// ParseAgentSinks parses sinks in audience=path form, e.g. billing-service=/run/tokens/billing.
+// Several audiences are separated by commas, an empty audience requests a token without one
+func ParseAgentSinks(specs []string) ([]AgentSink, error) {
+	sinks := make([]AgentSink, 0, len(specs))
+	for _, spec := range specs {
+		audience, path, ok := strings.Cut(spec, "=")
+		path = strings.TrimSpace(path)
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid sink %q: expected audience=path", spec)
+		}
+		sink := AgentSink{Audience: splitAudience(audience), Path: path}
+		slices.Sort(sink.Audience)
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// AgentListener fetches tokens from the issuer, keeps them fresh and serves them to local
+// processes over a Unix socket, so workloads on a machine do not each call the issuer.
+// Only the configured audiences are served, so callers cannot make it hold any number of tokens
+type AgentListener struct {
+	issuerURL  string
+	socketPath string
+	audiences  [][]string
+	sinks      []AgentSink
+	served     map[string]bool
+	logger     zerolog.Logger
+	done       chan struct{}
+
+	mu      sync.Mutex
+	sources map[string]*client.TokenSource
+}
+
+// NewAgentListener creates a new instance of AgentListener
+func NewAgentListener() (*AgentListener, error) {
+	logger := utils.GetLogger("agent-listener")
+
+	issuerURL, err := utils.IssuerURL()
+	if err != nil {
+		return nil, err
+	}
+
+	socketPath := viper.GetString("agent.socket")
+	if socketPath == "" {
+		return nil, fmt.Errorf("agent socket is not set")
+	}
+
+	sinks, err := ParseAgentSinks(viper.GetStringSlice("agent.sinks"))
+	if err != nil {
+		return nil, err
+	}
+
+	// a token without an audience is always served
+	served := map[string]bool{audienceKey(nil): true}
+	var audiences [][]string
+	for _, audience := range viper.GetStringSlice("agent.audiences") {
+		audiences = append(audiences, []string{audience})
+		served[audienceKey([]string{audience})] = true
+	}
+	for _, sink := range sinks {
+		served[audienceKey(sink.Audience)] = true
+	}
+
+	return &AgentListener{
+		issuerURL:  issuerURL,
+		socketPath: socketPath,
+		audiences:  audiences,
+		sinks:      sinks,
+		served:     served,
+		logger:     logger,
+		done:       make(chan struct{}),
+		sources:    make(map[string]*client.TokenSource),
+	}, nil
+}
+
+func (s *AgentListener) Start() error {
+	s.logger.Info().
+		Str("socket", s.socketPath).
+		Str("issuer", s.issuerURL).
+		Msg("creating agent listener")
+
+	// a socket left behind by an agent that did not shut down cleanly would fail Listen
+	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	ln, err := listenUnix(s.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to create listener: %w", err)
+	}
+
+	// fetch the configured tokens right away, so sinks are written before anyone asks
+	for _, audience := range s.audiences {
+		go s.prefetch(audience)
+	}
+	for _, sink := range s.sinks {
+		go s.prefetch(sink.Audience)
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reqLogger := s.logger.With().
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Logger()
+
+			reqLogger.Debug().Msg("handling request")
+
+			switch r.URL.Path {
+			case "/_healthz":
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"ok":      true,
+					"version": utils.Version,
+					"commit":  utils.Commit,
+				})
+
+			case "/issue":
+				s.handleIssue(w, r, reqLogger)
+
+			case "/token":
+				s.handleToken(w, r, reqLogger)
+
+			default:
+				http.NotFound(w, r)
+			}
+		}),
+	}
+
+	go func() {
+		<-s.done
+		s.logger.Info().Msg("received shutdown signal")
+		server.Close()
+	}()
+
+	s.logger.Info().
+		Str("socket", s.socketPath).
+		Msg("starting agent listener")
+	if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *AgentListener) Stop() {
+	s.logger.Info().Msg("stopping agent listener")
+	close(s.done)
+
+	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+		s.logger.Error().Err(err).Msg("failed to remove socket")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, source := range s.sources {
+		source.Close()
+	}
+}
+
+// handleIssue answers like the issuer's /issue endpoint, so the agent can stand in for it
+func (s *AgentListener) handleIssue(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	token, ok := s.requestedToken(w, r, reqLogger)
+	if !ok {
+		return
+	}
+
+	resp := map[string]string{
+		"token": token.AccessToken,
+	}
+	if tokenType := token.Type(); tokenType != "Bearer" {
+		resp["token_type"] = tokenType
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleToken answers with the bare token, for scripts
+func (s *AgentListener) handleToken(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	token, ok := s.requestedToken(w, r, reqLogger)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, token.AccessToken)
+}
+
+// requestedToken returns the token for the audience of a request, writing the error response if
+// there is none
+func (s *AgentListener) requestedToken(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) (*oauth2.Token, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "failed to parse request", http.StatusBadRequest)
+		return nil, false
+	}
+
+	if !s.served[audienceKey(r.Form["audience"])] {
+		reqLogger.Warn().Strs("audience", r.Form["audience"]).Msg("audience not served")
+		http.Error(w, "audience is not served by this agent", http.StatusForbidden)
+		return nil, false
+	}
+
+	token, err := s.source(r.Form["audience"]).TokenContext(r.Context())
+	if err != nil {
+		reqLogger.Error().Err(err).Strs("audience", r.Form["audience"]).Msg("failed to get token")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil, false
+	}
+
+	return token, true
+}
+
+// source returns the token source for an audience, creating it on first use
+func (s *AgentListener) source(audience []string) *client.TokenSource {
+	audience = slices.Clone(audience)
+	slices.Sort(audience)
+	key := audienceKey(audience)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if source, ok := s.sources[key]; ok {
+		return source
+	}
+
+	var sinks []string
+	for _, sink := range s.sinks {
+		if slices.Equal(sink.Audience, audience) {
+			sinks = append(sinks, sink.Path)
+		}
+	}
+
+	// the issuer URL is checked when the agent is created, so this cannot fail
+	source, _ := client.NewTokenSource(client.Config{
+		IssuerURL: s.issuerURL,
+		Audience:  audience,
+		OnToken: func(token *oauth2.Token) {
+			s.logger.Info().
+				Strs("audience", audience).
+				Time("expires_at", token.Expiry).
+				Msg("fetched token")
+
+			for _, path := range sinks {
+				if err := utils.WriteFileAtomic(path, []byte(token.AccessToken), 0600); err != nil {
+					s.logger.Error().Err(err).Str("path", path).Msg("failed to write token sink")
+				}
+			}
+		},
+	})
+	s.sources[key] = source
+	return source
+}
+
+// prefetch gets the first token for an audience, retrying until it succeeds. The token source
+// keeps it fresh from then on
+func (s *AgentListener) prefetch(audience []string) {
+	source := s.source(audience)
+	for {
+		_, err := source.Token()
+		if err == nil || errors.Is(err, client.ErrClosed) {
+			return
+		}
+
+		s.logger.Error().Err(err).Strs("audience", audience).Msg("failed to fetch token")
+		select {
+		case <-s.done:
+			return
+		case <-time.After(agentRetryInterval):
+		}
+	}
+}
+
+// audienceKey identifies a set of audiences regardless of their order
+func audienceKey(audience []string) string {
+	audience = slices.Clone(audience)
+	slices.Sort(audience)
+	return strings.Join(audience, "\n")
+}
+
+// listenUnix listens on a Unix socket only the current user can connect to. The socket is
+// created in a private directory and moved into place, so it is never reachable with the
+// permissions of the umask, e.g. in a shared temporary directory
+func listenUnix(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".tailbone-agent-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "agent.sock")
+	ln, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	// the socket is removed by Stop under its final name
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to set socket mode: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to move socket into place: %w", err)
+	}
+	return ln, nil
+}
+
+// splitAudience splits a comma separated audience list, dropping empty entries
+func splitAudience(audience string) []string {
+	var audiences []string
+	for _, a := range strings.Split(audience, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			audiences = append(audiences, a)
+		}
+	}
+	return audiences
+}
@@ -0,0 +1,289 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+
+	"github.com/altacoda/tailbone/utils"
+)
+
+const (
+	// auditTailChunkSize is how much of the audit file Tail reads at a time, from the end
+	auditTailChunkSize = 64 << 10
+	// maxAuditTailSize limits how much of each audit file Tail reads
+	maxAuditTailSize = 16 << 20
+)
+
+const (
+	AuditActionIssueToken = "token.issue"
+
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+	AuditOutcomeDenied  = "denied"
+)
+
+// AuditEvent is a single entry of the audit log
+type AuditEvent struct {
+	Time     time.Time       `json:"time"`
+	Action   string          `json:"action"`
+	Actor    *CallerIdentity `json:"actor,omitempty"`
+	Subject  string          `json:"sub,omitempty"`
+	KeyID    string          `json:"kid,omitempty"`
+	Audience []string        `json:"audience,omitempty"`
+	TokenID  string          `json:"jti,omitempty"`
+	Outcome  string          `json:"outcome"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// WithResult sets the outcome of the event from the error returned by the audited action
+func (e AuditEvent) WithResult(err error) AuditEvent {
+	if err != nil {
+		e.Outcome = AuditOutcomeFailure
+		e.Error = err.Error()
+	} else {
+		e.Outcome = AuditOutcomeSuccess
+	}
+
+	return e
+}
+
+// Auditor records audit events
+type Auditor interface {
+	// Record writes an event to the audit log. The actor is taken from ctx when not set
+	Record(ctx context.Context, event AuditEvent)
+	// Tail returns up to limit of the most recent events, oldest first
+	Tail(ctx context.Context, limit int) ([]AuditEvent, error)
+	Close() error
+}
+
+// auditLog writes audit events to a JSONL file and, optionally, to a webhook
+type auditLog struct {
+	logger  zerolog.Logger
+	file    *utils.RotatingFile
+	webhook string
+	client  *http.Client
+	events  chan AuditEvent
+	// mu guards the file, events and closed. Events recorded after Close are only logged
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewAuditor creates an Auditor from the audit configuration. Events are only
+// logged if neither an audit file nor a webhook is configured
+func NewAuditor(_ context.Context) (Auditor, error) {
+	a := &auditLog{
+		logger:  utils.GetLogger("audit"),
+		webhook: viper.GetString("audit.webhook"),
+	}
+
+	if path := viper.GetString("audit.file"); path != "" {
+		file, err := utils.NewRotatingFile(path, viper.GetInt64("audit.maxSize")*1024*1024, viper.GetInt("audit.maxBackups"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit file: %w", err)
+		}
+		a.file = file
+		a.logger.Info().Str("file", path).Msg("writing audit log to file")
+	}
+
+	if a.webhook != "" {
+		a.client = &http.Client{Timeout: viper.GetDuration("audit.webhookTimeout")}
+		a.events = make(chan AuditEvent, 1000)
+		a.wg.Add(1)
+		go a.deliver()
+		a.logger.Info().Str("webhook", a.webhook).Msg("sending audit events to webhook")
+	}
+
+	if a.file == nil && a.webhook == "" {
+		a.logger.Warn().Msg("no audit file or webhook configured. audit events will only be logged")
+	}
+
+	return a, nil
+}
+
+func (a *auditLog) Record(ctx context.Context, event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	if event.Actor == nil {
+		event.Actor, _ = CallerIdentityFromContext(ctx)
+	}
+
+	logEvent := a.logger.Info().
+		Str("action", event.Action).
+		Str("outcome", event.Outcome).
+		Str("sub", event.Subject).
+		Str("kid", event.KeyID).
+		Str("jti", event.TokenID)
+	if event.Actor != nil {
+		logEvent = logEvent.Str("actor", event.Actor.LoginName).Str("actor_node", event.Actor.NodeName)
+	}
+	logEvent.Msg("audit event")
+
+	if a.file == nil && a.events == nil {
+		return
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("failed to marshal audit event")
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		a.logger.Warn().Str("action", event.Action).Msg("audit log is closed. dropping event")
+		return
+	}
+
+	if a.file != nil {
+		if _, err := a.file.Write(append(line, '\n')); err != nil {
+			a.logger.Error().Err(err).Msg("failed to write audit event")
+		}
+	}
+
+	if a.events != nil {
+		select {
+		case a.events <- event:
+		default:
+			a.logger.Error().Str("action", event.Action).Msg("audit webhook queue is full. dropping event")
+		}
+	}
+}
+
+func (a *auditLog) Tail(_ context.Context, limit int) ([]AuditEvent, error) {
+	if a.file == nil {
+		return nil, fmt.Errorf("audit file is not configured")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	events, err := readAuditTail(a.file.Path(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// the current file may have just been rotated
+	if limit <= 0 || len(events) < limit {
+		previous, err := readAuditTail(a.file.BackupPath(1), limit-len(events))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		events = append(previous, events...)
+	}
+
+	return events, nil
+}
+
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	if a.events != nil {
+		close(a.events)
+	}
+	a.mu.Unlock()
+
+	// let queued events reach the webhook
+	a.wg.Wait()
+
+	if a.file != nil {
+		return a.file.Close()
+	}
+
+	return nil
+}
+
+// deliver posts queued events to the webhook
+func (a *auditLog) deliver() {
+	defer a.wg.Done()
+
+	for event := range a.events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			a.logger.Error().Err(err).Msg("failed to marshal audit event")
+			continue
+		}
+
+		resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			a.logger.Error().Err(err).Str("action", event.Action).Msg("failed to send audit event to webhook")
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			a.logger.Error().Int("status", resp.StatusCode).Str("action", event.Action).Msg("audit webhook rejected event")
+		}
+	}
+}
+
+// readAuditTail returns up to limit of the last events in an audit file, oldest first, or as many
+// as fit in maxAuditTailSize if limit is not positive. The file is read backwards from the end, so
+// only the requested events are held in memory
+func readAuditTail(path string, limit int) ([]AuditEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit file: %w", err)
+	}
+
+	var events []AuditEvent
+	var partial []byte
+	offset := info.Size()
+	for offset > 0 && info.Size()-offset < maxAuditTailSize && (limit <= 0 || len(events) < limit) {
+		size := min(offset, auditTailChunkSize)
+		offset -= size
+
+		chunk := make([]byte, size, int(size)+len(partial))
+		if _, err := file.ReadAt(chunk, offset); err != nil {
+			return nil, fmt.Errorf("failed to read audit file: %w", err)
+		}
+		data := append(chunk, partial...)
+
+		// the first line of a chunk is only complete at the start of the file
+		for limit <= 0 || len(events) < limit {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 && offset > 0 {
+				break
+			}
+
+			var event AuditEvent
+			if err := json.Unmarshal(data[i+1:], &event); err == nil {
+				events = append(events, event)
+			}
+
+			if i < 0 {
+				data = nil
+				break
+			}
+			data = data[:i]
+		}
+		partial = data
+	}
+
+	slices.Reverse(events)
+	return events, nil
+}
@@ -0,0 +1,205 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"tailscale.com/tsnet"
+
+	"github.com/altacoda/tailbone/dpop"
+	"github.com/altacoda/tailbone/utils"
+)
+
+// authzContextAudience is the Envoy context extension overriding the required audiences of a route
+const authzContextAudience = "audience"
+
+var errClaimMismatch = errors.New("token does not satisfy the claim rules")
+
+// AuthzListener implements Envoy's external authorization gRPC API (envoy.service.auth.v3).
+// Requests are allowed when they carry a valid Tailbone token matching the configured rules
+type AuthzListener struct {
+	authv3.UnimplementedAuthorizationServer
+	server     *tsnet.Server
+	issuer     Issuer
+	dpop       *dpop.Verifier
+	audiences  []string
+	rules      ClaimRules
+	grpcServer *grpc.Server
+	logger     zerolog.Logger
+	done       chan struct{}
+}
+
+// NewAuthzListener creates a new instance of AuthzListener
+func NewAuthzListener(ctx context.Context, tsServer *tsnet.Server) (*AuthzListener, error) {
+	logger := utils.GetLogger("authz-listener")
+	logger.Info().Msg("initializing authz listener")
+
+	rules, err := ParseClaimRules(viper.GetStringSlice("authz.require"))
+	if err != nil {
+		return nil, err
+	}
+
+	issuer, err := NewTokenIssuer(ctx, IssuerConfig{
+		KeyDir:      viper.GetString("keys.dir"),
+		Revocations: NewRevocationStore(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token issuer: %w", err)
+	}
+
+	return &AuthzListener{
+		server:     tsServer,
+		issuer:     issuer,
+		dpop:       dpop.NewVerifier(dpop.DefaultMaxAge),
+		audiences:  viper.GetStringSlice("authz.audiences"),
+		rules:      rules,
+		grpcServer: grpc.NewServer(),
+		logger:     logger,
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// ReloadKeys reloads the keys tokens are verified with
+func (s *AuthzListener) ReloadKeys(ctx context.Context) error {
+	return s.issuer.ReloadKeys(ctx)
+}
+
+func (s *AuthzListener) Start() error {
+	port := viper.GetInt("authz.port")
+	binding := viper.GetString("authz.binding")
+	s.logger.Info().
+		Str("binding", binding).
+		Int("port", port).
+		Msg("creating authz listener")
+
+	lis, err := s.server.Listen("tcp", fmt.Sprintf("%s:%d", binding, port))
+	if err != nil {
+		return fmt.Errorf("failed to create listener: %w", err)
+	}
+
+	authv3.RegisterAuthorizationServer(s.grpcServer, s)
+
+	go func() {
+		<-s.done
+		s.logger.Info().Msg("received shutdown signal")
+		s.grpcServer.GracefulStop()
+	}()
+
+	s.logger.Info().
+		Str("binding", binding).
+		Int("port", port).
+		Msg("starting authz listener")
+	return s.grpcServer.Serve(lis)
+}
+
+func (s *AuthzListener) Stop() {
+	s.logger.Info().Msg("stopping authz listener")
+	close(s.done)
+}
+
+// Check implements the Check RPC method. Denials are returned as a response, not as an error,
+// so Envoy sends the denied HTTP response to the client
+func (s *AuthzListener) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	httpReq := req.GetAttributes().GetRequest().GetHttp()
+	reqLogger := s.logger.With().
+		Str("method", httpReq.GetMethod()).
+		Str("host", httpReq.GetHost()).
+		Str("path", httpReq.GetPath()).
+		Logger()
+
+	claims, err := s.authenticate(ctx, httpReq)
+	if err != nil {
+		reqLogger.Warn().Err(err).Msg("request not authenticated")
+		return deniedResponse(codes.Unauthenticated, http.StatusUnauthorized, err), nil
+	}
+
+	audiences := s.audiences
+	if value, ok := req.GetAttributes().GetContextExtensions()[authzContextAudience]; ok {
+		audiences = strings.Split(value, ",")
+	}
+	if err := checkAudience(claims, audiences); err != nil {
+		reqLogger.Warn().Err(err).Str("sub", claims.Subject).Msg("request not authorized")
+		return deniedResponse(codes.PermissionDenied, http.StatusForbidden, err), nil
+	}
+
+	if !s.rules.Match(claims) {
+		reqLogger.Warn().Str("sub", claims.Subject).Msg("request not authorized")
+		return deniedResponse(codes.PermissionDenied, http.StatusForbidden, errClaimMismatch), nil
+	}
+
+	reqLogger.Debug().Str("sub", claims.Subject).Str("jti", claims.ID).Msg("request authorized")
+	return okResponse(claims), nil
+}
+
+// authenticate verifies the token of a request
+func (s *AuthzListener) authenticate(ctx context.Context, httpReq *authv3.AttributeContext_HttpRequest) (*TokenClaims, error) {
+	// Envoy passes header names in lower case
+	headers := httpReq.GetHeaders()
+	path, _, _ := strings.Cut(httpReq.GetPath(), "?")
+	return verifyPresentedToken(ctx, s.issuer, s.dpop, presentedToken{
+		Authorization: headers["authorization"],
+		Proof:         headers[strings.ToLower(dpop.HeaderName)],
+		Method:        httpReq.GetMethod(),
+		URL:           fmt.Sprintf("%s://%s%s", httpReq.GetScheme(), httpReq.GetHost(), path),
+	})
+}
+
+// okResponse allows a request and passes the identity of the caller to the upstream
+func okResponse(claims *TokenClaims) *authv3.CheckResponse {
+	values := identityHeaderValues(claims)
+
+	var headers []*corev3.HeaderValueOption
+	var headersToRemove []string
+	for _, name := range identityHeaders {
+		if values[name] == "" {
+			// so clients cannot pass their own
+			headersToRemove = append(headersToRemove, name)
+			continue
+		}
+		headers = append(headers, &corev3.HeaderValueOption{
+			Header:       &corev3.HeaderValue{Key: name, Value: values[name]},
+			AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
+	}
+
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{
+			OkResponse: &authv3.OkHttpResponse{
+				Headers:         headers,
+				HeadersToRemove: headersToRemove,
+			},
+		},
+	}
+}
+
+// deniedResponse denies a request with the given HTTP status
+func deniedResponse(code codes.Code, httpStatus int, err error) *authv3.CheckResponse {
+	resp := &authv3.DeniedHttpResponse{
+		Status: &typev3.HttpStatus{Code: typev3.StatusCode(httpStatus)},
+		Body:   err.Error(),
+	}
+	if httpStatus == http.StatusUnauthorized {
+		resp.Headers = []*corev3.HeaderValueOption{{
+			Header: &corev3.HeaderValue{Key: "WWW-Authenticate", Value: `Bearer realm="tailbone"`},
+		}}
+	}
+
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(code), Message: err.Error()},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: resp,
+		},
+	}
+}
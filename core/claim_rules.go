@@ -0,0 +1,37 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/altacoda/tailbone/verifier"
+)
+
+// ClaimRules restrict the tokens a service accepts by their claims. Each claim is mapped to the
+// values it may have: a token matches if, for every claim, its value or one of its values is allowed
+type ClaimRules map[string][]string
+
+// ParseClaimRules parses rules in claim=value form, e.g. tags=tag:prod or user=alice@example.com.
+// Rules for the same claim allow any of their values
+func ParseClaimRules(rules []string) (ClaimRules, error) {
+	parsed := make(ClaimRules)
+	for _, rule := range rules {
+		claim, value, ok := strings.Cut(rule, "=")
+		claim = strings.TrimSpace(claim)
+		if !ok || claim == "" {
+			return nil, fmt.Errorf("invalid claim rule %q: expected claim=value", rule)
+		}
+		parsed[claim] = append(parsed[claim], strings.TrimSpace(value))
+	}
+	return parsed, nil
+}
+
+// Match returns true if the claims satisfy all rules
+func (r ClaimRules) Match(claims *TokenClaims) bool {
+	for claim, allowed := range r {
+		if verifier.RequireClaim(claim, allowed...)(claims) != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,318 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+
+	"github.com/altacoda/tailbone/utils"
+)
+
+var (
+	// ErrClientNotFound is returned when no client is registered with the given ID
+	ErrClientNotFound = errors.New("client not found")
+	// ErrClientExists is returned when registering a client ID that is already taken
+	ErrClientExists = errors.New("client already exists")
+	// ErrClientReadOnly is returned when deleting a client defined in the configuration
+	ErrClientReadOnly = errors.New("client is defined in the configuration")
+)
+
+// ClientGrantTypes are the grant types a client can be registered for
+var ClientGrantTypes = []string{GrantTypeAuthorizationCode, GrantTypeClientCredentials, GrantTypeTokenExchange}
+
+// Client is a registered relying party. Only a hash of the client secret is kept
+type Client struct {
+	ID           string   `json:"client_id"`
+	SecretHash   string   `json:"secret_hash,omitempty"`
+	RedirectURIs []string `json:"redirect_uris,omitempty"`
+	// Audiences limits the audiences the client can request tokens for
+	Audiences  []string `json:"audiences,omitempty"`
+	GrantTypes []string `json:"grant_types"`
+	CreatedAt  int64    `json:"created_at"`
+}
+
+// Public reports whether the client has no secret and must use PKCE instead
+func (c *Client) Public() bool {
+	return c.SecretHash == ""
+}
+
+// AllowsRedirectURI reports whether uri is one of the registered redirect URIs.
+// Redirect URIs are compared exactly, as required by OAuth 2.0 Security BCP
+func (c *Client) AllowsRedirectURI(uri string) bool {
+	return slices.Contains(c.RedirectURIs, uri)
+}
+
+// AllowsGrantType reports whether the client is registered for the grant type
+func (c *Client) AllowsGrantType(grantType string) bool {
+	return slices.Contains(c.GrantTypes, grantType)
+}
+
+// AllowsAudience reports whether the client can request tokens for the audience.
+// Clients registered without audiences can only get tokens for themselves
+func (c *Client) AllowsAudience(audience string) bool {
+	if len(c.Audiences) == 0 {
+		return audience == c.ID
+	}
+	return slices.Contains(c.Audiences, audience)
+}
+
+// Authenticate checks the client secret presented by the client
+func (c *Client) Authenticate(secret string) bool {
+	if c.Public() {
+		return secret == ""
+	}
+	return subtle.ConstantTimeCompare([]byte(c.SecretHash), []byte(hashOpaqueToken(secret))) == 1
+}
+
+// configClient is a client defined in the oidc.clients setting
+type configClient struct {
+	ID           string   `mapstructure:"id"`
+	Secret       string   `mapstructure:"secret"`
+	RedirectURIs []string `mapstructure:"redirect_uris"`
+	Audiences    []string `mapstructure:"audiences"`
+	GrantTypes   []string `mapstructure:"grant_types"`
+}
+
+// ClientRegistry persists registered clients in a local file. Clients defined in the
+// oidc.clients setting are merged in and cannot be changed through the registry
+type ClientRegistry struct {
+	path   string
+	static []Client
+	logger zerolog.Logger
+	mu     sync.Mutex
+}
+
+// NewClientRegistry creates a client registry backed by the configured clients file
+func NewClientRegistry() (*ClientRegistry, error) {
+	path := viper.GetString("clients.file")
+	if path == "" {
+		path = filepath.Join(viper.GetString("keys.dir"), "clients.json")
+	}
+
+	static, err := loadConfigClients()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ClientRegistry{
+		path:   path,
+		static: static,
+		logger: utils.GetLogger("clients"),
+	}, nil
+}
+
+// loadConfigClients reads the clients defined in the oidc.clients setting
+func loadConfigClients() ([]Client, error) {
+	var list []configClient
+	if err := viper.UnmarshalKey("oidc.clients", &list); err != nil {
+		return nil, fmt.Errorf("failed to read OIDC clients: %w", err)
+	}
+
+	clients := make([]Client, 0, len(list))
+	for _, entry := range list {
+		if entry.ID == "" {
+			return nil, fmt.Errorf("OIDC client without an id")
+		}
+		if slices.ContainsFunc(clients, func(client Client) bool { return client.ID == entry.ID }) {
+			return nil, fmt.Errorf("OIDC client %s is registered more than once", entry.ID)
+		}
+
+		client := Client{
+			ID:           entry.ID,
+			RedirectURIs: entry.RedirectURIs,
+			Audiences:    entry.Audiences,
+			GrantTypes:   entry.GrantTypes,
+		}
+		if len(client.GrantTypes) == 0 {
+			client.GrantTypes = []string{GrantTypeAuthorizationCode}
+		}
+		if entry.Secret != "" {
+			client.SecretHash = hashOpaqueToken(entry.Secret)
+		}
+		if err := validateClient(client); err != nil {
+			return nil, fmt.Errorf("invalid OIDC client %s: %w", entry.ID, err)
+		}
+
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
+// Get returns the client registered with the given ID
+func (r *ClientRegistry) Get(_ context.Context, id string) (*Client, error) {
+	if client, ok := r.staticClient(id); ok {
+		return client, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, client := range clients {
+		if client.ID == id {
+			return &client, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrClientNotFound, id)
+}
+
+// List returns all registered clients, including those defined in the configuration, sorted by ID
+func (r *ClientRegistry) List(_ context.Context) ([]Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// clients defined in the configuration take precedence over registered ones
+	clients = slices.DeleteFunc(clients, func(client Client) bool {
+		_, ok := r.staticClient(client.ID)
+		return ok
+	})
+	clients = append(clients, r.static...)
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients, nil
+}
+
+// Register adds a client to the registry. A client ID is generated if none is given and,
+// unless the client is public, a secret is generated and returned. The secret cannot be
+// retrieved later
+func (r *ClientRegistry) Register(_ context.Context, client Client, public bool) (string, *Client, error) {
+	if client.ID == "" {
+		client.ID = uuid.NewString()
+	}
+	if len(client.GrantTypes) == 0 {
+		client.GrantTypes = []string{GrantTypeAuthorizationCode}
+	}
+	if _, ok := r.staticClient(client.ID); ok {
+		return "", nil, fmt.Errorf("%w: %s", ErrClientExists, client.ID)
+	}
+
+	var secret string
+	if !public {
+		var err error
+		if secret, err = newOpaqueToken(); err != nil {
+			return "", nil, err
+		}
+		client.SecretHash = hashOpaqueToken(secret)
+	}
+	if err := validateClient(client); err != nil {
+		return "", nil, err
+	}
+	client.CreatedAt = time.Now().Unix()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients, err := r.load()
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, existing := range clients {
+		if existing.ID == client.ID {
+			return "", nil, fmt.Errorf("%w: %s", ErrClientExists, client.ID)
+		}
+	}
+
+	if err := r.save(append(clients, client)); err != nil {
+		return "", nil, err
+	}
+
+	r.logger.Info().Str("client_id", client.ID).Strs("grant_types", client.GrantTypes).Msg("registered client")
+	return secret, &client, nil
+}
+
+// Delete removes a client from the registry
+func (r *ClientRegistry) Delete(_ context.Context, id string) error {
+	if _, ok := r.staticClient(id); ok {
+		return fmt.Errorf("%w: %s", ErrClientReadOnly, id)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	remaining := slices.DeleteFunc(clients, func(client Client) bool { return client.ID == id })
+	if len(remaining) == len(clients) {
+		return fmt.Errorf("%w: %s", ErrClientNotFound, id)
+	}
+	if err := r.save(remaining); err != nil {
+		return err
+	}
+
+	r.logger.Info().Str("client_id", id).Msg("deleted client")
+	return nil
+}
+
+// staticClient returns the client with the given ID from the configuration
+func (r *ClientRegistry) staticClient(id string) (*Client, bool) {
+	for _, client := range r.static {
+		if client.ID == id {
+			return &client, true
+		}
+	}
+	return nil, false
+}
+
+// validateClient checks the grant types and redirect URIs of a client
+func validateClient(client Client) error {
+	for _, grantType := range client.GrantTypes {
+		if !slices.Contains(ClientGrantTypes, grantType) {
+			return fmt.Errorf("unsupported grant type %s", grantType)
+		}
+	}
+	if client.AllowsGrantType(GrantTypeAuthorizationCode) && len(client.RedirectURIs) == 0 {
+		return fmt.Errorf("the authorization_code grant requires at least one redirect URI")
+	}
+	if client.Public() && client.AllowsGrantType(GrantTypeClientCredentials) {
+		return fmt.Errorf("public clients cannot use the client_credentials grant")
+	}
+	return nil
+}
+
+func (r *ClientRegistry) load() ([]Client, error) {
+	var clients []Client
+	if err := utils.ReadJSONFile(r.path, &clients); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		r.logger.Error().Err(err).Str("file", r.path).Msg("failed to load clients")
+		return nil, fmt.Errorf("failed to load clients: %w", err)
+	}
+
+	return clients, nil
+}
+
+func (r *ClientRegistry) save(clients []Client) error {
+	if err := utils.WriteJSONFile(r.path, clients, 0600); err != nil {
+		r.logger.Error().Err(err).Str("file", r.path).Msg("failed to save clients")
+		return fmt.Errorf("failed to save clients: %w", err)
+	}
+
+	return nil
+}
@@ -2,16 +2,34 @@ package core
 
 import (
 	"context"
+	"sync"
+	"time"
 
-	"github.com/altacoda/tailbone/utils"
 	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+
+	"github.com/altacoda/tailbone/utils"
 )
 
+// HouseKeepingStatus holds the outcome of the last housekeeping run
+type HouseKeepingStatus struct {
+	LastRun     time.Time        `json:"last_run"`
+	LastSuccess time.Time        `json:"last_success"`
+	LastError   string           `json:"last_error,omitempty"`
+	DeletedKeys int              `json:"deleted_keys"`
+	InvalidKeys []utils.KeyCheck `json:"invalid_keys,omitempty"`
+	Runs        int              `json:"runs"`
+}
+
 type HouseKeeper struct {
 	logger          zerolog.Logger
 	cloudConnector  utils.CloudConnector
 	tokenGenerator  utils.IKeyManager
 	localKeyStorage utils.ILocalKeyStorage
+	onKeysChanged   []func(ctx context.Context) error
+	mu              sync.Mutex
+	status          HouseKeepingStatus
+	done            chan struct{}
 }
 
 func NewHouseKeeper(ctx context.Context) (*HouseKeeper, error) {
@@ -30,11 +48,87 @@ func NewHouseKeeper(ctx context.Context) (*HouseKeeper, error) {
 		cloudConnector:  cloudConnector,
 		tokenGenerator:  tokenGenerator,
 		localKeyStorage: localKeyStorage,
+		done:            make(chan struct{}),
 	}, nil
 }
 
+// OnKeysChanged registers a callback that is called when housekeeping changes the local key set
+func (h *HouseKeeper) OnKeysChanged(fn func(ctx context.Context) error) {
+	h.onKeysChanged = append(h.onKeysChanged, fn)
+}
+
+// Start runs housekeeping periodically until Stop is called
+func (h *HouseKeeper) Start() error {
+	interval := viper.GetDuration("housekeeping.interval")
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	h.logger.Info().Dur("interval", interval).Msg("starting periodic housekeeping")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := h.Run(ctx); err != nil {
+			h.logger.Error().Err(err).Msg("housekeeping failed")
+		}
+		cancel()
+
+		select {
+		case <-h.done:
+			h.logger.Info().Msg("periodic housekeeping stopped")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *HouseKeeper) Stop() {
+	h.logger.Info().Msg("stopping housekeeper")
+	close(h.done)
+}
+
+// Status returns the outcome of the last housekeeping run
+func (h *HouseKeeper) Status() interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.status
+}
+
+// Run performs a single housekeeping pass and records its outcome
 func (h *HouseKeeper) Run(ctx context.Context) error {
+	deleted, invalid, err := h.run(ctx)
+
+	h.mu.Lock()
+	h.status.LastRun = time.Now()
+	h.status.Runs++
+	h.status.DeletedKeys = deleted
+	h.status.InvalidKeys = invalid
+	if err != nil {
+		h.status.LastError = err.Error()
+	} else {
+		h.status.LastError = ""
+		h.status.LastSuccess = h.status.LastRun
+	}
+	h.mu.Unlock()
+
+	if deleted > 0 {
+		for _, fn := range h.onKeysChanged {
+			if err := fn(ctx); err != nil {
+				h.logger.Error().Err(err).Msg("failed to notify key set change")
+			}
+		}
+	}
+
+	return err
+}
+
+func (h *HouseKeeper) run(ctx context.Context) (int, []utils.KeyCheck, error) {
 	h.logger.Info().Msg("starting housekeeping")
+	deleted := 0
 
 	// download JWKs from the URL and compare with the local JWKs
 	// if they are different, upload the new JWKs to the S3 bucket
@@ -44,7 +138,7 @@ func (h *HouseKeeper) Run(ctx context.Context) error {
 	localJWKs, err := h.localKeyStorage.GetLocalJWKs(ctx)
 	if err != nil {
 		h.logger.Error().Err(err).Msg("failed to get local JWKs")
-		return err
+		return deleted, nil, err
 	}
 
 	h.logger.Info().Int("local_jwks", len(localJWKs.Keys)).Msg("got local JWKs")
@@ -52,18 +146,19 @@ func (h *HouseKeeper) Run(ctx context.Context) error {
 	bucket, keyPath, err := h.cloudConnector.GetBucketAndKeyPath(ctx)
 	if err != nil {
 		h.logger.Error().Err(err).Msg("failed to get bucket and key path")
-		return err
+		return deleted, nil, err
 	}
 
 	remoteJWKs, err := h.tokenGenerator.DownloadJWKS(ctx, bucket, keyPath)
 	if err != nil {
 		h.logger.Error().Err(err).Msg("failed to download JWKs from S3")
-		return err
+		return deleted, nil, err
 	}
 
 	h.logger.Info().Int("remote_jwks", len(remoteJWKs.Keys)).Msg("got remote JWKs")
 
 	// comprare by key
+	removed := make(map[string]bool)
 	for _, localKey := range localJWKs.Keys {
 		found := false
 		for _, remoteKey := range remoteJWKs.Keys {
@@ -73,17 +168,44 @@ func (h *HouseKeeper) Run(ctx context.Context) error {
 			}
 		}
 
-		if !found {
+		// public and private files of the same key share a key ID
+		if !found && !removed[localKey.KeyID()] {
 			h.logger.Info().Str("keyID", localKey.KeyID()).Msg("deleting local key")
 			err := h.localKeyStorage.DeleteLocalJWK(ctx, localKey.KeyID())
 			if err != nil {
 				h.logger.Error().Err(err).Msg("failed to delete local key")
-				return err
+				return deleted, nil, err
 			}
+			removed[localKey.KeyID()] = true
+			deleted++
 		}
 	}
 
-	h.logger.Info().Msg("housekeeping completed")
+	// make sure the remaining keys match their published counterparts
+	checks, err := h.localKeyStorage.VerifyLocalJWKs(ctx, remoteJWKs)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("failed to verify local JWKs")
+		return deleted, nil, err
+	}
 
-	return nil
+	var invalid []utils.KeyCheck
+	for _, check := range checks {
+		if !check.OK() {
+			h.logger.Error().
+				Str("keyID", check.KeyID).
+				Str("status", string(check.Status)).
+				Str("detail", check.Detail).
+				Msg("key failed verification")
+			invalid = append(invalid, check)
+		}
+	}
+
+	h.logger.Info().
+		Int("deleted_keys", deleted).
+		Int("invalid_keys", len(invalid)).
+		Msg("housekeeping completed")
+
+	return deleted, invalid, nil
 }
+
+var _ utils.IServer = &HouseKeeper{}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"context"
+	"slices"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// CallerIdentity is the Tailscale identity of a caller as returned by WhoIs
+type CallerIdentity struct {
+	LoginName   string   `json:"login_name"`
+	DisplayName string   `json:"display_name"`
+	NodeName    string   `json:"node_name,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Addr        string   `json:"addr,omitempty"`
+	// Capabilities holds the names of the peer capabilities granted to the caller
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+type callerIdentityKey struct{}
+
+// NewCallerIdentity builds a CallerIdentity from a WhoIs response
+func NewCallerIdentity(addr string, who *apitype.WhoIsResponse) *CallerIdentity {
+	identity := &CallerIdentity{
+		Addr: addr,
+	}
+
+	if who.UserProfile != nil {
+		identity.LoginName = who.UserProfile.LoginName
+		identity.DisplayName = who.UserProfile.DisplayName
+	}
+
+	if who.Node != nil {
+		identity.NodeName = who.Node.Name
+		identity.Tags = who.Node.Tags
+	}
+
+	for capability := range who.CapMap {
+		identity.Capabilities = append(identity.Capabilities, string(capability))
+	}
+	slices.Sort(identity.Capabilities)
+
+	return identity
+}
+
+// WithCallerIdentity returns a copy of ctx carrying the caller identity
+func WithCallerIdentity(ctx context.Context, identity *CallerIdentity) context.Context {
+	return context.WithValue(ctx, callerIdentityKey{}, identity)
+}
+
+// CallerIdentityFromContext returns the caller identity stored in ctx, if any
+func CallerIdentityFromContext(ctx context.Context) (*CallerIdentity, bool) {
+	identity, ok := ctx.Value(callerIdentityKey{}).(*CallerIdentity)
+	return identity, ok
+}
@@ -2,47 +2,137 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/rs/zerolog"
 	"github.com/spf13/viper"
 
 	"github.com/altacoda/tailbone/utils"
+	"github.com/altacoda/tailbone/verifier"
 )
 
 // Issuer defines the interface for JWT token operations
 type Issuer interface {
 	// IssueToken creates a new JWT token for a Tailscale user
-	IssueToken(ctx context.Context, tailscaleUser, displayName string) (string, error)
+	IssueToken(ctx context.Context, req TokenRequest) (*IssuedToken, error)
+	// IssueIDToken creates an OpenID Connect ID token for a Tailscale user
+	IssueIDToken(ctx context.Context, req IDTokenRequest) (*IssuedToken, error)
 	// GetJWKS returns the JSON Web Key Set
 	GetJWKS(ctx context.Context) jwk.Set
 	// VerifyToken verifies and parses a JWT token
 	VerifyToken(ctx context.Context, tokenString string) (*TokenClaims, error)
+	// ReloadKeys reloads the key set from the key directory
+	ReloadKeys(ctx context.Context) error
 }
 
 // IssuerConfig holds the configuration for the token issuer
 type IssuerConfig struct {
-	KeyDir string // Directory containing the JWK files
+	KeyDir      string            // Directory containing the JWK files
+	Revocations *RevocationStore  // Revoked tokens, checked by VerifyToken when set
+	SPIFFE      *SPIFFEIDTemplate // Issue JWT-SVIDs with SPIFFE IDs as subject when set
 }
 
+// ErrAudienceRequired is returned when issuing a JWT-SVID without an audience
+var ErrAudienceRequired = errors.New("audience is required")
+
+// minKeyReloadInterval limits how often tokens signed with an unknown key trigger a reload
+const minKeyReloadInterval = 10 * time.Second
+
+// IDTokenType is the typ header of ID tokens. It keeps them from being accepted as access tokens
+const IDTokenType = "id_token+jwt"
+
 // TokenIssuer handles JWT token issuance and verification
 type TokenIssuer struct {
-	keySet jwk.Set
-	config IssuerConfig
-	logger zerolog.Logger
+	mu         sync.RWMutex
+	keySet     jwk.Set
+	reloadedAt time.Time
+	config     IssuerConfig
+	logger     zerolog.Logger
+}
+
+// TokenRequest describes the token to issue
+type TokenRequest struct {
+	User         string      // Tailscale login name of the user
+	DisplayName  string      // Display name of the user
+	Node         string      // Tailscale node name of the caller, if any
+	Tags         []string    // Tags of the caller's node, if any
+	Audience     []string    // Intended audience of the token, if any
+	Capabilities []string    // Names of the peer capabilities granted to the caller, if any
+	Actor        *ActorClaim // Party acting on behalf of the user, for delegated tokens
+	// KeyThumbprint binds the token to the client's DPoP key (RFC 9449), if set
+	KeyThumbprint string
+	// NotAfter caps the expiry of the token, so a derived token never outlives the one it came from
+	NotAfter time.Time
+}
+
+// IDTokenRequest describes the OpenID Connect ID token to issue
+type IDTokenRequest struct {
+	User        string    // Tailscale login name of the user
+	DisplayName string    // Display name of the user
+	ClientID    string    // Client the ID token is issued to
+	Nonce       string    // Nonce sent by the client in the authorization request
+	AuthTime    time.Time // Time the user was identified
+}
+
+// IssuedToken holds a signed token and the details needed to track it
+type IssuedToken struct {
+	Token     string
+	ID        string
+	KeyID     string
+	Audience  []string
+	ExpiresAt time.Time
+}
+
+// TokenClaims represents the custom claims in our JWT, see the verifier package
+type TokenClaims = verifier.TokenClaims
+
+// Confirmation binds a token to a key of its holder (RFC 7800)
+type Confirmation = verifier.Confirmation
+
+// ActorClaim identifies the party acting on behalf of the subject of a token
+type ActorClaim = verifier.ActorClaim
+
+// UserInfo holds the standard OpenID Connect profile claims of a Tailscale user
+type UserInfo struct {
+	Subject           string `json:"sub"`
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+}
+
+// NewUserInfo returns the profile claims of a Tailscale user
+func NewUserInfo(loginName, displayName string) UserInfo {
+	info := UserInfo{
+		Subject:           loginName,
+		Name:              displayName,
+		PreferredUsername: loginName,
+	}
+
+	// Tailscale login names of users are email addresses, tagged nodes have none
+	if strings.Contains(loginName, "@") {
+		info.Email = loginName
+	}
+
+	return info
 }
 
-// TokenClaims represents the custom claims in our JWT
-type TokenClaims struct {
+// IDTokenClaims represents the claims of an OpenID Connect ID token
+type IDTokenClaims struct {
 	jwt.RegisteredClaims
-	User        string `json:"user"`
-	DisplayName string `json:"display_name"`
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+	AuthTime          int64  `json:"auth_time,omitempty"`
+	Nonce             string `json:"nonce,omitempty"`
 }
 
 // NewTokenIssuer creates a new JWT issuer with keys loaded from files
@@ -61,13 +151,84 @@ func NewTokenIssuer(ctx context.Context, cfg IssuerConfig) (Issuer, error) {
 
 	if key == nil {
 		logger.Warn().Str("dir", cfg.KeyDir).Msg("no valid key files found in directory. issue function will fail")
-	} else {
-		issuer.keySet = jwk.NewSet()
+	}
+
+	if err := issuer.ReloadKeys(ctx); err != nil {
+		return nil, fmt.Errorf("failed to load keys: %w", err)
 	}
 
 	return issuer, nil
 }
 
+// ReloadKeys replaces the key set with all private keys found in the key directory
+func (i *TokenIssuer) ReloadKeys(_ context.Context) error {
+	entries, err := os.ReadDir(i.config.KeyDir)
+	if err != nil {
+		i.logger.Error().Err(err).Msg("failed to read key directory")
+		return fmt.Errorf("failed to read key directory: %w", err)
+	}
+
+	keySet := jwk.NewSet()
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".private.jwk") {
+			continue
+		}
+
+		keyBytes, err := os.ReadFile(filepath.Join(i.config.KeyDir, entry.Name()))
+		if err != nil {
+			i.logger.Error().Err(err).Str("key", entry.Name()).Msg("failed to read key file")
+			continue
+		}
+
+		key, err := jwk.ParseKey(keyBytes)
+		if err != nil {
+			i.logger.Error().Err(err).Str("key", entry.Name()).Msg("failed to parse key")
+			continue
+		}
+
+		if err := keySet.AddKey(key); err != nil {
+			i.logger.Error().Err(err).Str("key", entry.Name()).Msg("failed to add key to set")
+			continue
+		}
+	}
+
+	i.mu.Lock()
+	i.keySet = keySet
+	i.reloadedAt = time.Now()
+	i.mu.Unlock()
+
+	i.logger.Info().Int("total_keys", keySet.Len()).Msg("loaded key set")
+	return nil
+}
+
+func (i *TokenIssuer) getKeySet() jwk.Set {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.keySet
+}
+
+// lookupKey finds the key kid, reloading the key set if it is unknown and was not reloaded
+// recently, in case the key was added by another process
+func (i *TokenIssuer) lookupKey(ctx context.Context, kid string) (jwk.Key, bool) {
+	if key, found := i.getKeySet().LookupKeyID(kid); found {
+		return key, true
+	}
+
+	i.mu.RLock()
+	recent := time.Since(i.reloadedAt) < minKeyReloadInterval
+	i.mu.RUnlock()
+	if recent {
+		return nil, false
+	}
+
+	i.logger.Info().Str("key", kid).Msg("token is signed with an unknown key. reloading key set")
+	if err := i.ReloadKeys(ctx); err != nil {
+		return nil, false
+	}
+	return i.getKeySet().LookupKeyID(kid)
+}
+
 func (i *TokenIssuer) loadLatestKey(_ context.Context) (jwk.Key, error) {
 	i.logger.Info().Str("dir", i.config.KeyDir).Msg("loading latest key")
 	// Find the most recent private key in the directory
@@ -125,66 +286,158 @@ func (i *TokenIssuer) loadLatestKey(_ context.Context) (jwk.Key, error) {
 }
 
 // IssueToken creates a new JWT token for a Tailscale user
-func (i *TokenIssuer) IssueToken(ctx context.Context, tailscaleUser, displayName string) (string, error) {
+func (i *TokenIssuer) IssueToken(ctx context.Context, req TokenRequest) (*IssuedToken, error) {
 	i.logger.Debug().
-		Str("user", tailscaleUser).
-		Str("display_name", displayName).
+		Str("user", req.User).
+		Str("display_name", req.DisplayName).
+		Strs("audience", req.Audience).
 		Msg("issuing new token")
 
-	key, err := i.loadLatestKey(ctx)
-	if err != nil {
-		return "", fmt.Errorf("failed to load latest key: %w", err)
+	// Create the claims
+	now := time.Now()
+	expiresAt := now.Add(viper.GetDuration("keys.expiry"))
+	if !req.NotAfter.IsZero() && req.NotAfter.Before(expiresAt) {
+		expiresAt = req.NotAfter
 	}
 
-	if key == nil {
-		return "", fmt.Errorf("no valid key files found in directory. issue function will fail")
-	}
+	// JWT-SVIDs carry the SPIFFE ID of the caller as subject and must have an audience
+	subject := req.User
+	if i.config.SPIFFE != nil {
+		if len(req.Audience) == 0 {
+			return nil, fmt.Errorf("failed to issue JWT-SVID: %w", ErrAudienceRequired)
+		}
 
-	// Get the raw private key for signing
-	var privateKey interface{}
-	if err := key.Raw(&privateKey); err != nil {
-		i.logger.Error().Err(err).Str("key", key.KeyID()).Msg("failed to get raw private key")
-		return "", fmt.Errorf("failed to get raw private key: %w", err)
+		var err error
+		if subject, err = i.config.SPIFFE.ID(req); err != nil {
+			return nil, err
+		}
 	}
 
-	// Create the claims
-	now := time.Now()
 	claims := TokenClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Subject:   subject,
 			Issuer:    viper.GetString("keys.issuer"),
+			Audience:  req.Audience,
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		User:         req.User,
+		DisplayName:  req.DisplayName,
+		Tags:         req.Tags,
+		Capabilities: req.Capabilities,
+		Act:          req.Actor,
+	}
+	if req.KeyThumbprint != "" {
+		claims.Cnf = &Confirmation{JKT: req.KeyThumbprint}
+	}
+
+	signedToken, kid, err := i.sign(ctx, claims, "")
+	if err != nil {
+		return nil, err
+	}
+
+	i.logger.Info().
+		Str("user", req.User).
+		Str("sub", subject).
+		Str("kid", kid).
+		Str("jti", claims.ID).
+		Str("fingerprint", utils.TokenFingerprint(signedToken)).
+		Msg("issued new token")
+
+	return &IssuedToken{
+		Token:     signedToken,
+		ID:        claims.ID,
+		KeyID:     kid,
+		Audience:  claims.Audience,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, nil
+}
+
+// IssueIDToken creates an OpenID Connect ID token for a Tailscale user
+func (i *TokenIssuer) IssueIDToken(ctx context.Context, req IDTokenRequest) (*IssuedToken, error) {
+	now := time.Now()
+	profile := NewUserInfo(req.User, req.DisplayName)
+	claims := IDTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Subject:   req.User,
+			Issuer:    viper.GetString("keys.issuer"),
+			Audience:  jwt.ClaimStrings{req.ClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(viper.GetDuration("keys.expiry"))),
 		},
-		User:        tailscaleUser,
-		DisplayName: displayName,
+		Name:              profile.Name,
+		PreferredUsername: profile.PreferredUsername,
+		Email:             profile.Email,
+		AuthTime:          req.AuthTime.Unix(),
+		Nonce:             req.Nonce,
+	}
+
+	signedToken, kid, err := i.sign(ctx, claims, IDTokenType)
+	if err != nil {
+		return nil, err
+	}
+
+	i.logger.Info().
+		Str("user", req.User).
+		Str("client_id", req.ClientID).
+		Str("kid", kid).
+		Str("jti", claims.ID).
+		Str("fingerprint", utils.TokenFingerprint(signedToken)).
+		Msg("issued new ID token")
+
+	return &IssuedToken{
+		Token:     signedToken,
+		ID:        claims.ID,
+		KeyID:     kid,
+		Audience:  claims.Audience,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, nil
+}
+
+// sign signs the claims with the most recent key and returns the token and the key ID. typ
+// overrides the typ header if set
+func (i *TokenIssuer) sign(ctx context.Context, claims jwt.Claims, typ string) (string, string, error) {
+	key, err := i.loadLatestKey(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load latest key: %w", err)
+	}
+
+	if key == nil {
+		return "", "", fmt.Errorf("no valid key files found in directory. issue function will fail")
+	}
+
+	// Get the raw private key for signing
+	var privateKey interface{}
+	if err := key.Raw(&privateKey); err != nil {
+		i.logger.Error().Err(err).Str("key", key.KeyID()).Msg("failed to get raw private key")
+		return "", "", fmt.Errorf("failed to get raw private key: %w", err)
 	}
 
 	// Create the token
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
 	token.Header["kid"] = key.KeyID()
+	if typ != "" {
+		token.Header["typ"] = typ
+	}
 
 	// Sign the token
 	signedToken, err := token.SignedString(privateKey)
 	if err != nil {
 		i.logger.Error().Err(err).Str("key", key.KeyID()).Msg("failed to sign token")
-		return "", fmt.Errorf("failed to sign token: %w", err)
+		return "", "", fmt.Errorf("failed to sign token: %w", err)
 	}
 
-	i.logger.Info().
-		Str("user", tailscaleUser).
-		Str("kid", key.KeyID()).
-		Msg("issued new token")
-
-	i.logger.Info().Str("token", signedToken).Msg("issued new token")
-
-	return signedToken, nil
+	return signedToken, key.KeyID(), nil
 }
 
 // GetJWKS returns the JSON Web Key Set
 func (i *TokenIssuer) GetJWKS(ctx context.Context) jwk.Set {
 	publicKeySet := jwk.NewSet()
-	for it := i.keySet.Keys(ctx); it.Next(ctx); {
+	keySet := i.getKeySet()
+	for it := keySet.Keys(ctx); it.Next(ctx); {
 		key := it.Pair().Value.(jwk.Key)
 		public, err := jwk.PublicKeyOf(key)
 		if err != nil {
@@ -201,6 +454,11 @@ func (i *TokenIssuer) GetJWKS(ctx context.Context) jwk.Set {
 // VerifyToken verifies and parses a JWT token
 func (i *TokenIssuer) VerifyToken(ctx context.Context, tokenString string) (*TokenClaims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		// ID tokens are signed with the same keys but only meant for OIDC clients
+		if typ, _ := token.Header["typ"].(string); typ == IDTokenType {
+			return nil, fmt.Errorf("ID tokens are not accepted as access tokens")
+		}
+
 		// Get the key ID from the token header
 		kid, ok := token.Header["kid"].(string)
 		if !ok {
@@ -209,21 +467,21 @@ func (i *TokenIssuer) VerifyToken(ctx context.Context, tokenString string) (*Tok
 		}
 
 		// Find the key in our key set
-		key, found := i.keySet.LookupKeyID(kid)
+		key, found := i.lookupKey(ctx, kid)
 		if !found {
 			i.logger.Error().Str("key", kid).Msg("key not found")
 			return nil, fmt.Errorf("key %s not found", kid)
 		}
 
-		// Get the public key
-		var publicKey interface{}
-		if err := key.Raw(&publicKey); err != nil {
+		// Get the public key, the key set holds the private keys
+		publicKey, err := jwk.PublicRawKeyOf(key)
+		if err != nil {
 			i.logger.Error().Err(err).Str("key", kid).Msg("failed to get public key")
 			return nil, fmt.Errorf("failed to get public key: %w", err)
 		}
 
 		return publicKey, nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}), jwt.WithIssuer(viper.GetString("keys.issuer")))
 
 	if err != nil {
 		i.logger.Error().Err(err).Msg("failed to parse token")
@@ -236,5 +494,17 @@ func (i *TokenIssuer) VerifyToken(ctx context.Context, tokenString string) (*Tok
 		return nil, fmt.Errorf("invalid token")
 	}
 
+	if i.config.Revocations != nil {
+		revoked, err := i.config.Revocations.IsRevoked(ctx, claims)
+		if err != nil {
+			i.logger.Error().Err(err).Msg("failed to check revocation list")
+			return nil, fmt.Errorf("failed to check revocation list: %w", err)
+		}
+		if revoked {
+			i.logger.Warn().Str("jti", claims.ID).Str("sub", claims.Subject).Msg("token has been revoked")
+			return nil, fmt.Errorf("token has been revoked")
+		}
+	}
+
 	return claims, nil
 }
@@ -5,43 +5,103 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
 
 	"github.com/rs/zerolog"
 	"github.com/spf13/viper"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/tsnet"
 
+	"github.com/altacoda/tailbone/dpop"
 	"github.com/altacoda/tailbone/utils"
 )
 
+// StatusReporter is implemented by components that expose their state on the health check endpoint
+type StatusReporter interface {
+	Status() interface{}
+}
+
 type IssuerListener struct {
-	client *tailscale.LocalClient
-	server *tsnet.Server
-	issuer Issuer
-	logger zerolog.Logger
-	done   chan struct{}
+	client        *tailscale.LocalClient
+	server        *tsnet.Server
+	issuer        Issuer
+	auditor       Auditor
+	revocations   *RevocationStore
+	refreshTokens *RefreshTokenStore
+	logger        zerolog.Logger
+	done          chan struct{}
+
+	// statuses can be registered while the listener is serving health checks
+	statusMu sync.RWMutex
+	statuses map[string]StatusReporter
+
+	clients            *ClientRegistry
+	authorizationCodes *authorizationCodeStore
+	dpop               *dpop.Verifier
+	spiffe             *SPIFFEIDTemplate
+	x509CA             *utils.CAStorage
+	sshCA              *utils.CAStorage
 }
 
-func NewIssuerListener(tsServer *tsnet.Server) (*IssuerListener, error) {
+func NewIssuerListener(tsServer *tsnet.Server, auditor Auditor) (*IssuerListener, error) {
 	// Configure global logger
 	logger := utils.GetLogger("issuer-listener")
 
+	spiffe, err := NewSPIFFEIDTemplateFromConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	clients, err := NewClientRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	revocations := NewRevocationStore()
 	issuer, err := NewTokenIssuer(context.Background(), IssuerConfig{
-		KeyDir: viper.GetString("keys.dir"),
+		KeyDir:      viper.GetString("keys.dir"),
+		Revocations: revocations,
+		SPIFFE:      spiffe,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create token issuer: %w", err)
 	}
 
 	return &IssuerListener{
-		issuer: issuer,
-		logger: logger,
-		server: tsServer,
-		done:   make(chan struct{}),
+		issuer:        issuer,
+		auditor:       auditor,
+		revocations:   revocations,
+		refreshTokens: NewRefreshTokenStore(),
+		logger:        logger,
+		server:        tsServer,
+		done:          make(chan struct{}),
+		statuses:      make(map[string]StatusReporter),
+
+		clients:            clients,
+		authorizationCodes: newAuthorizationCodeStore(),
+		dpop:               dpop.NewVerifier(dpop.DefaultMaxAge),
+		spiffe:             spiffe,
+		x509CA:             utils.NewCAStorage(utils.KeyTypeX509CA),
+		sshCA:              utils.NewCAStorage(utils.KeyTypeSSHCA),
 	}, nil
 }
 
+// RegisterStatus adds the status of a component to the health check response
+func (s *IssuerListener) RegisterStatus(name string, reporter StatusReporter) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.statuses[name] = reporter
+}
+
+// ReloadKeys reloads the signing keys of the issuer
+func (s *IssuerListener) ReloadKeys(ctx context.Context) error {
+	s.logger.Info().Msg("reloading issuer keys")
+	return s.issuer.ReloadKeys(ctx)
+}
+
 func (s *IssuerListener) Start() error {
 	logger := s.logger
 	logger.Info().Msg("initializing issuer listener")
@@ -53,15 +113,31 @@ func (s *IssuerListener) Start() error {
 	if err != nil {
 		return fmt.Errorf("failed to create local client: %w", err)
 	}
-	port := viper.GetInt("server.port")
 	binding := viper.GetString("server.binding")
+	useTLS := viper.GetBool("server.tls")
+
+	// the port defaults to the standard port of the scheme
+	port := viper.GetInt("server.port")
+	if port == 0 {
+		port = 80
+		if useTLS {
+			port = 443
+		}
+	}
 
 	logger.Info().
 		Int("port", port).
 		Str("binding", binding).
+		Bool("tls", useTLS).
 		Msg("creating issuer listener")
 
-	ln, err := s.server.Listen("tcp", fmt.Sprintf("%s:%d", binding, port))
+	var ln net.Listener
+	if useTLS {
+		// serves the certificate for the MagicDNS name of the node, fetched from Tailscale on first use
+		ln, err = s.server.ListenTLS("tcp", fmt.Sprintf("%s:%d", binding, port))
+	} else {
+		ln, err = s.server.Listen("tcp", fmt.Sprintf("%s:%d", binding, port))
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create listener: %w", err)
 	}
@@ -72,7 +148,6 @@ func (s *IssuerListener) Start() error {
 	// Create HTTP server
 	server := &http.Server{
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx := r.Context()
 			reqLogger := logger.With().
 				Str("remote_addr", r.RemoteAddr).
 				Str("method", r.Method).
@@ -83,44 +158,62 @@ func (s *IssuerListener) Start() error {
 
 			switch r.URL.Path {
 			case "/_healthz":
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]interface{}{
+				health := map[string]interface{}{
 					"ok":      true,
 					"version": utils.Version,
 					"commit":  utils.Commit,
-				})
+				}
+				s.statusMu.RLock()
+				for name, reporter := range s.statuses {
+					health[name] = reporter.Status()
+				}
+				s.statusMu.RUnlock()
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(health)
 				return
 
 			case "/issue":
-				// Only allow POST requests
-				if r.Method != http.MethodPost {
-					http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-					return
-				}
+				s.handleIssue(w, r, reqLogger)
 
-				// Authenticate and issue token
-				who, err := s.client.WhoIs(ctx, r.RemoteAddr)
-				if err != nil {
-					reqLogger.Error().Err(err).Msg("failed to identify user")
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+			case "/token":
+				s.handleToken(w, r, reqLogger)
 
-				token, err := s.issuer.IssueToken(ctx, who.UserProfile.LoginName, who.UserProfile.DisplayName)
-				if err != nil {
-					reqLogger.Error().Err(err).Msg("failed to issue token")
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+			case "/revocations":
+				s.handleRevocations(w, r, reqLogger)
+
+			case "/authorize":
+				s.handleAuthorize(w, r, reqLogger)
+
+			case "/userinfo":
+				s.handleUserInfo(w, r, reqLogger)
+
+			case "/.well-known/openid-configuration":
+				s.handleDiscovery(w, r, reqLogger)
+
+			case "/.well-known/jwks.json":
+				s.handleJWKS(w, r, reqLogger)
+
+			case "/spiffe/bundle":
+				s.handleSPIFFEBundle(w, r, reqLogger)
+
+			case "/issue/x509":
+				s.handleIssueX509(w, r, reqLogger)
+
+			case "/x509/ca.pem":
+				s.handleX509Bundle(w, r, reqLogger)
 
-				reqLogger.Info().
-					Str("user", who.UserProfile.LoginName).
-					Str("display_name", who.UserProfile.DisplayName).
-					Msg("issued token")
+			case "/verify":
+				s.handleVerify(w, r, reqLogger)
 
-				json.NewEncoder(w).Encode(map[string]string{
-					"token": token,
-				})
+			case "/k8s/tokenreview":
+				s.handleTokenReview(w, r, reqLogger)
+
+			case "/issue/ssh":
+				s.handleIssueSSH(w, r, reqLogger)
+
+			case "/ssh/ca.pub":
+				s.handleSSHCAKeys(w, r, reqLogger)
 
 			default:
 				http.NotFound(w, r)
@@ -165,4 +258,114 @@ func (s *IssuerListener) Stop() {
 	close(s.done)
 }
 
+// handleIssue issues a token to the Tailscale identity of the caller
+func (s *IssuerListener) handleIssue(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	ctx := r.Context()
+
+	// Only allow POST requests
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "failed to parse request", http.StatusBadRequest)
+		return
+	}
+
+	// Authenticate and issue token
+	who, err := s.client.WhoIs(ctx, r.RemoteAddr)
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to identify user")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Bind the token to the caller's key if it sent a DPoP proof
+	var thumbprint string
+	if proof := r.Header.Get(dpop.HeaderName); proof != "" {
+		verified, err := s.dpop.Verify(proof, r.Method, issuerBaseURL(r)+r.URL.Path, "")
+		if err != nil {
+			reqLogger.Warn().Err(err).Msg("DPoP proof rejected")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		thumbprint = verified.Thumbprint
+	}
+
+	identity := NewCallerIdentity(r.RemoteAddr, who)
+	token, err := s.issuer.IssueToken(ctx, TokenRequest{
+		User:          who.UserProfile.LoginName,
+		DisplayName:   who.UserProfile.DisplayName,
+		Node:          identity.NodeName,
+		Tags:          identity.Tags,
+		Capabilities:  identity.Capabilities,
+		Audience:      r.Form["audience"],
+		KeyThumbprint: thumbprint,
+	})
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to issue token")
+		s.auditor.Record(ctx, AuditEvent{Action: AuditActionIssueToken, Actor: identity}.WithResult(err))
+		if errors.Is(err, ErrAudienceRequired) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.auditor.Record(ctx, AuditEvent{
+		Action:   AuditActionIssueToken,
+		Actor:    identity,
+		Subject:  who.UserProfile.LoginName,
+		KeyID:    token.KeyID,
+		Audience: token.Audience,
+		TokenID:  token.ID,
+	}.WithResult(nil))
+
+	reqLogger.Info().
+		Str("user", who.UserProfile.LoginName).
+		Str("display_name", who.UserProfile.DisplayName).
+		Msg("issued token")
+
+	resp := map[string]string{
+		"token": token.Token,
+	}
+	if thumbprint != "" {
+		resp["token_type"] = dpop.TokenType
+	}
+
+	// Optionally hand out a refresh token bound to the caller's node and DPoP key
+	if refresh, _ := strconv.ParseBool(r.FormValue("refresh")); refresh {
+		refreshToken, _, err := s.refreshTokens.Issue(ctx, who.UserProfile.LoginName, who.Node.Key.String(), thumbprint, "")
+		if err != nil {
+			reqLogger.Error().Err(err).Msg("failed to issue refresh token")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp["refresh_token"] = refreshToken
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleRevocations serves the revocation list so verifiers can check it
+func (s *IssuerListener) handleRevocations(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list, err := s.revocations.List(r.Context())
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to load revocation list")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
 var _ utils.IServer = &IssuerListener{}
@@ -0,0 +1,512 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+
+	"github.com/altacoda/tailbone/dpop"
+)
+
+const (
+	GrantTypeRefreshToken      = "refresh_token"
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	TokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"
+
+	AuditActionRefreshToken     = "token.refresh"
+	AuditActionExchangeToken    = "token.exchange"
+	AuditActionClientCredential = "token.client_credentials"
+)
+
+// errInvalidClient is returned when a client presents unknown or wrong credentials
+var errInvalidClient = errors.New("client authentication failed")
+
+// tokenResponse is the OAuth 2.0 token endpoint response
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	// IssuedTokenType is set by the token exchange grant (RFC 8693 section 2.2.1)
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+// oauthError is the OAuth 2.0 error response (RFC 6749 section 5.2)
+type oauthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// handleToken implements an OAuth 2.0 token endpoint
+func (s *IssuerListener) handleToken(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "failed to parse request")
+		return
+	}
+
+	grantType := r.PostForm.Get("grant_type")
+	reqLogger = reqLogger.With().Str("grant_type", grantType).Logger()
+
+	switch grantType {
+	case GrantTypeAuthorizationCode:
+		s.authorizationCodeGrant(w, r, reqLogger)
+	case GrantTypeRefreshToken:
+		s.refreshTokenGrant(w, r, reqLogger)
+	case GrantTypeClientCredentials:
+		s.clientCredentialsGrant(w, r, reqLogger)
+	case GrantTypeTokenExchange:
+		s.tokenExchangeGrant(w, r, reqLogger)
+	case "":
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "grant_type is required")
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "grant type is not supported")
+	}
+}
+
+// refreshTokenGrant exchanges a refresh token for a new access token and a rotated refresh token.
+// The caller must be the same, still connected, Tailscale node the refresh token was issued to
+func (s *IssuerListener) refreshTokenGrant(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	ctx := r.Context()
+
+	refreshToken := r.PostForm.Get("refresh_token")
+	if refreshToken == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "refresh_token is required")
+		return
+	}
+
+	who, err := s.client.WhoIs(ctx, r.RemoteAddr)
+	if err != nil {
+		reqLogger.Warn().Err(err).Msg("failed to identify caller")
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "caller is not a node of the tailnet")
+		return
+	}
+
+	identity := NewCallerIdentity(r.RemoteAddr, who)
+	event := AuditEvent{Action: AuditActionRefreshToken, Actor: identity, Subject: identity.LoginName}
+
+	var proof *dpop.Proof
+	if header := r.Header.Get(dpop.HeaderName); header != "" {
+		if proof, err = s.dpop.Verify(header, r.Method, issuerBaseURL(r)+r.URL.Path, ""); err != nil {
+			reqLogger.Warn().Err(err).Msg("DPoP proof rejected")
+			s.auditor.Record(ctx, event.WithResult(err))
+			writeOAuthError(w, http.StatusBadRequest, "invalid_dpop_proof", "DPoP proof is not valid")
+			return
+		}
+	}
+
+	record, err := s.refreshTokens.Use(ctx, refreshToken, who.Node.Key.String())
+	if err != nil {
+		reqLogger.Warn().Err(err).Msg("refresh token rejected")
+		s.auditor.Record(ctx, event.WithResult(err))
+		if errors.Is(err, ErrInvalidRefreshToken) {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		} else {
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to check refresh token")
+		}
+		return
+	}
+
+	if record.Subject != identity.LoginName {
+		err := errors.New("refresh token was issued to a different user")
+		reqLogger.Warn().Str("sub", record.Subject).Msg(err.Error())
+		s.auditor.Record(ctx, event.WithResult(err))
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	// A refresh token bound to a DPoP key is only used by the holder of the key, and the new
+	// tokens stay bound to it. Without a binding, a proof binds the new access token like on /issue
+	thumbprint := record.KeyThumbprint
+	if thumbprint != "" {
+		if err := dpop.CheckBinding(thumbprint, proof); err != nil {
+			reqLogger.Warn().Err(err).Msg("DPoP proof rejected")
+			s.auditor.Record(ctx, event.WithResult(err))
+			writeOAuthError(w, http.StatusBadRequest, "invalid_dpop_proof", "refresh_token is bound to a key, a DPoP proof signed with it is required")
+			return
+		}
+	} else if proof != nil {
+		thumbprint = proof.Thumbprint
+	}
+
+	revoked, err := s.revocations.IsRevoked(ctx, &TokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:  record.Subject,
+			IssuedAt: jwt.NewNumericDate(time.Unix(record.IssuedAt, 0)),
+		},
+	})
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to check revocation list")
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to check revocation list")
+		return
+	}
+	if revoked {
+		err := errors.New("refresh token has been revoked")
+		s.auditor.Record(ctx, event.WithResult(err))
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	token, err := s.issuer.IssueToken(ctx, TokenRequest{
+		User:          identity.LoginName,
+		DisplayName:   identity.DisplayName,
+		Node:          identity.NodeName,
+		Tags:          identity.Tags,
+		Capabilities:  identity.Capabilities,
+		Audience:      r.PostForm["audience"],
+		KeyThumbprint: thumbprint,
+	})
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to issue token")
+		s.auditor.Record(ctx, event.WithResult(err))
+		if errors.Is(err, ErrAudienceRequired) {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		} else {
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to issue token")
+		}
+		return
+	}
+
+	newRefreshToken, _, err := s.refreshTokens.Issue(ctx, record.Subject, record.NodeKey, record.KeyThumbprint, record.FamilyID)
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to rotate refresh token")
+		s.auditor.Record(ctx, event.WithResult(err))
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to rotate refresh token")
+		return
+	}
+
+	event.KeyID = token.KeyID
+	event.Audience = token.Audience
+	event.TokenID = token.ID
+	s.auditor.Record(ctx, event.WithResult(nil))
+
+	reqLogger.Info().
+		Str("user", identity.LoginName).
+		Str("jti", token.ID).
+		Msg("refreshed token")
+
+	tokenType := "Bearer"
+	if thumbprint != "" {
+		tokenType = dpop.TokenType
+	}
+
+	writeTokenResponse(w, tokenResponse{
+		AccessToken:  token.Token,
+		TokenType:    tokenType,
+		ExpiresIn:    int64(time.Until(token.ExpiresAt).Seconds()),
+		RefreshToken: newRefreshToken,
+	})
+}
+
+// tokenExchangeGrant implements OAuth 2.0 Token Exchange (RFC 8693) for delegation: a service
+// presents a token it received from a user and gets a token for a different audience that
+// carries the user as subject and the service's Tailscale node as actor
+func (s *IssuerListener) tokenExchangeGrant(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	ctx := r.Context()
+
+	subjectToken := r.PostForm.Get("subject_token")
+	if subjectToken == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "subject_token is required")
+		return
+	}
+
+	switch r.PostForm.Get("subject_token_type") {
+	case TokenTypeAccessToken, TokenTypeJWT:
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "subject_token_type must be an access token or a JWT")
+		return
+	}
+
+	switch r.PostForm.Get("requested_token_type") {
+	case "", TokenTypeAccessToken, TokenTypeJWT:
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "requested_token_type is not supported")
+		return
+	}
+
+	audience := r.PostForm["audience"]
+	if len(audience) == 0 {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "audience is required")
+		return
+	}
+
+	// token exchange is disabled until audiences are allowed for it
+	rules := viper.GetStringSlice("exchange.audiences")
+	if len(rules) == 0 {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "token exchange is not enabled")
+		return
+	}
+
+	// Registered clients are held to the grant types and audiences they were registered for
+	client, err := s.authenticateClient(r)
+	if err != nil {
+		writeClientError(w, r, err, reqLogger)
+		return
+	}
+	if client != nil {
+		if !client.AllowsGrantType(GrantTypeTokenExchange) {
+			writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "client is not allowed to use the token exchange grant")
+			return
+		}
+		for _, aud := range audience {
+			if !client.AllowsAudience(aud) {
+				writeOAuthError(w, http.StatusBadRequest, "invalid_target", fmt.Sprintf("audience %s is not allowed for this client", aud))
+				return
+			}
+		}
+	}
+
+	who, err := s.client.WhoIs(ctx, r.RemoteAddr)
+	if err != nil {
+		reqLogger.Warn().Err(err).Msg("failed to identify caller")
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "caller is not a node of the tailnet")
+		return
+	}
+
+	identity := NewCallerIdentity(r.RemoteAddr, who)
+	event := AuditEvent{Action: AuditActionExchangeToken, Actor: identity, Audience: audience}
+
+	// the calling service acts as the user, so it must be allowed to for every audience
+	for _, aud := range audience {
+		if !exchangeAllowed(identity, aud, rules) {
+			err := fmt.Errorf("%s is not allowed to exchange tokens for audience %s", identity.NodeName, aud)
+			reqLogger.Warn().Err(err).Msg("token exchange denied")
+			s.auditor.Record(ctx, event.WithResult(err))
+			writeOAuthError(w, http.StatusBadRequest, "invalid_target", fmt.Sprintf("audience %s is not allowed", aud))
+			return
+		}
+	}
+
+	subject, err := s.issuer.VerifyToken(ctx, subjectToken)
+	if err != nil {
+		reqLogger.Warn().Err(err).Msg("subject token rejected")
+		s.auditor.Record(ctx, event.WithResult(err))
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "subject_token is not valid")
+		return
+	}
+	event.Subject = subject.Subject
+
+	// A token bound to a DPoP key is only exchanged by the holder of the key, and the new token
+	// stays bound to it
+	var thumbprint string
+	if subject.Cnf != nil {
+		proof, err := s.dpop.Verify(r.Header.Get(dpop.HeaderName), r.Method, issuerBaseURL(r)+r.URL.Path, "")
+		if err == nil {
+			err = dpop.CheckBinding(subject.Cnf.JKT, proof)
+		}
+		if err != nil {
+			reqLogger.Warn().Err(err).Msg("DPoP proof rejected")
+			s.auditor.Record(ctx, event.WithResult(err))
+			writeOAuthError(w, http.StatusBadRequest, "invalid_dpop_proof", "subject_token is bound to a key, a DPoP proof signed with it is required")
+			return
+		}
+		thumbprint = subject.Cnf.JKT
+	}
+
+	// the new token never outlives the subject token
+	var notAfter time.Time
+	if subject.ExpiresAt != nil {
+		notAfter = subject.ExpiresAt.Time
+	}
+
+	token, err := s.issuer.IssueToken(ctx, TokenRequest{
+		User:         subject.User,
+		DisplayName:  subject.DisplayName,
+		Tags:         subject.Tags,
+		Capabilities: subject.Capabilities,
+		Audience:     audience,
+		Actor: &ActorClaim{
+			Subject: identity.NodeName,
+			User:    identity.LoginName,
+			Act:     subject.Act,
+		},
+		NotAfter:      notAfter,
+		KeyThumbprint: thumbprint,
+	})
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to issue token")
+		s.auditor.Record(ctx, event.WithResult(err))
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to issue token")
+		return
+	}
+
+	event.KeyID = token.KeyID
+	event.TokenID = token.ID
+	s.auditor.Record(ctx, event.WithResult(nil))
+
+	reqLogger.Info().
+		Str("user", subject.User).
+		Str("actor", identity.NodeName).
+		Strs("audience", audience).
+		Str("jti", token.ID).
+		Msg("exchanged token")
+
+	tokenType := "Bearer"
+	if thumbprint != "" {
+		tokenType = dpop.TokenType
+	}
+
+	writeTokenResponse(w, tokenResponse{
+		AccessToken:     token.Token,
+		TokenType:       tokenType,
+		ExpiresIn:       int64(time.Until(token.ExpiresAt).Seconds()),
+		IssuedTokenType: TokenTypeAccessToken,
+	})
+}
+
+// exchangeAllowed checks whether the caller can exchange tokens for the audience. Rules are of
+// the form <audience>=<principal> and allow the callers matching the principal (user:<login>,
+// user:*@<domain>, tag:<tag> or cap:<capability>)
+func exchangeAllowed(actor *CallerIdentity, audience string, rules []string) bool {
+	for _, rule := range rules {
+		ruleAudience, principal, ok := strings.Cut(rule, "=")
+		if ok && ruleAudience == audience && matchesAnyPrincipal(actor, []string{principal}) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientCredentialsGrant issues a token to a registered confidential client for itself. The caller
+// is identified by its client secret rather than its Tailscale identity, so this suits workloads
+// that reach the tailnet without a node of their own, e.g. through a subnet router
+func (s *IssuerListener) clientCredentialsGrant(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	ctx := r.Context()
+
+	client, err := s.authenticateClient(r)
+	if err != nil || client == nil {
+		writeClientError(w, r, err, reqLogger)
+		return
+	}
+	reqLogger = reqLogger.With().Str("client_id", client.ID).Logger()
+
+	if client.Public() || !client.AllowsGrantType(GrantTypeClientCredentials) {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "client is not allowed to use the client credentials grant")
+		return
+	}
+
+	// Without an explicit audience the token is issued for every audience of the client
+	audience := r.PostForm["audience"]
+	if len(audience) == 0 {
+		audience = client.Audiences
+		if len(audience) == 0 {
+			audience = []string{client.ID}
+		}
+	}
+	for _, aud := range audience {
+		if !client.AllowsAudience(aud) {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_target", fmt.Sprintf("audience %s is not allowed for this client", aud))
+			return
+		}
+	}
+
+	event := AuditEvent{Action: AuditActionClientCredential, Subject: client.ID, Audience: audience}
+
+	token, err := s.issuer.IssueToken(ctx, TokenRequest{
+		User:     client.ID,
+		Audience: audience,
+	})
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to issue token")
+		s.auditor.Record(ctx, event.WithResult(err))
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to issue token")
+		return
+	}
+
+	event.KeyID = token.KeyID
+	event.TokenID = token.ID
+	s.auditor.Record(ctx, event.WithResult(nil))
+
+	reqLogger.Info().
+		Strs("audience", audience).
+		Str("jti", token.ID).
+		Msg("issued client token")
+
+	writeTokenResponse(w, tokenResponse{
+		AccessToken: token.Token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(time.Until(token.ExpiresAt).Seconds()),
+	})
+}
+
+// authenticateClient identifies the registered client calling the token endpoint. Clients
+// authenticate with HTTP basic auth or with form parameters. A nil client and error means
+// the request carries no client credentials
+func (s *IssuerListener) authenticateClient(r *http.Request) (*Client, error) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		// basic auth credentials are form encoded (RFC 6749 section 2.3.1)
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	if clientID == "" {
+		return nil, nil
+	}
+
+	client, err := s.clients.Get(r.Context(), clientID)
+	if err != nil {
+		if errors.Is(err, ErrClientNotFound) {
+			return nil, errInvalidClient
+		}
+		return nil, err
+	}
+
+	if !client.Authenticate(clientSecret) {
+		return nil, errInvalidClient
+	}
+
+	return client, nil
+}
+
+// writeClientError responds to a request whose client could not be authenticated
+func writeClientError(w http.ResponseWriter, r *http.Request, err error, reqLogger zerolog.Logger) {
+	if err != nil && !errors.Is(err, errInvalidClient) {
+		reqLogger.Error().Err(err).Msg("failed to look up client")
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to look up client")
+		return
+	}
+
+	reqLogger.Warn().Msg("client authentication failed")
+	if _, _, ok := r.BasicAuth(); ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="tailbone"`)
+	}
+	writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+}
+
+func writeTokenResponse(w http.ResponseWriter, resp tokenResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(oauthError{
+		Error:            code,
+		ErrorDescription: description,
+	})
+}
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+const (
+	// TokenReviewAPIVersion is the API version of the TokenReview webhook contract
+	TokenReviewAPIVersion = "authentication.k8s.io/v1"
+	// TokenReviewKind is the kind of TokenReview objects
+	TokenReviewKind = "TokenReview"
+
+	AuditActionTokenReview = "kubernetes.token_review"
+)
+
+// Keys of the extra fields of authenticated users
+const (
+	tokenReviewExtraDisplayName = "tailbone.altacoda.com/display-name"
+	tokenReviewExtraTokenID     = "tailbone.altacoda.com/token-id"
+	tokenReviewExtraActor       = "tailbone.altacoda.com/actor"
+)
+
+// maxTokenReviewSize limits the size of TokenReview requests
+const maxTokenReviewSize = 64 << 10
+
+// TokenReview is the authentication.k8s.io/v1 object Kubernetes API servers send to
+// authentication webhooks. Only the fields used by webhooks are defined
+type TokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       TokenReviewSpec   `json:"spec"`
+	Status     TokenReviewStatus `json:"status"`
+}
+
+// TokenReviewSpec holds the token to authenticate
+type TokenReviewSpec struct {
+	Token string `json:"token"`
+	// Audiences the API server accepts, the token must be issued for one of them
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+// TokenReviewStatus is the result of authenticating a token
+type TokenReviewStatus struct {
+	Authenticated bool               `json:"authenticated"`
+	User          KubernetesUserInfo `json:"user"`
+	// Audiences are the requested audiences the token was issued for
+	Audiences []string `json:"audiences,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// KubernetesUserInfo describes an authenticated Kubernetes user
+type KubernetesUserInfo struct {
+	Username string              `json:"username,omitempty"`
+	Groups   []string            `json:"groups,omitempty"`
+	Extra    map[string][]string `json:"extra,omitempty"`
+}
+
+// handleTokenReview implements the Kubernetes webhook token authentication contract. The API
+// server POSTs a TokenReview and gets it back with the status filled in. Rejected tokens are
+// not an HTTP error, the status just says the token is not authenticated
+func (s *IssuerListener) handleTokenReview(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var review TokenReview
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTokenReviewSize)).Decode(&review); err != nil {
+		http.Error(w, "failed to parse TokenReview", http.StatusBadRequest)
+		return
+	}
+	if review.APIVersion != TokenReviewAPIVersion || review.Kind != TokenReviewKind {
+		http.Error(w, "expected a "+TokenReviewAPIVersion+" "+TokenReviewKind, http.StatusBadRequest)
+		return
+	}
+
+	event := AuditEvent{Action: AuditActionTokenReview}
+	if who, err := s.client.WhoIs(ctx, r.RemoteAddr); err == nil {
+		event.Actor = NewCallerIdentity(r.RemoteAddr, who)
+	}
+
+	status, claims, err := s.reviewToken(r, review.Spec)
+	if claims != nil {
+		event.Subject = claims.Subject
+		event.TokenID = claims.ID
+		event.Audience = claims.Audience
+	}
+	if err != nil {
+		reqLogger.Warn().Err(err).Msg("token review rejected token")
+		status = TokenReviewStatus{Error: err.Error()}
+	}
+	s.auditor.Record(ctx, event.WithResult(err))
+
+	review.Spec.Token = ""
+	review.Status = status
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(review)
+}
+
+// reviewToken verifies the token of a TokenReview and describes the user it was issued to.
+// Groups are the tags and peer capabilities in the token
+func (s *IssuerListener) reviewToken(r *http.Request, spec TokenReviewSpec) (TokenReviewStatus, *TokenClaims, error) {
+	if spec.Token == "" {
+		return TokenReviewStatus{}, nil, errors.New("token is required")
+	}
+
+	claims, err := s.issuer.VerifyToken(r.Context(), spec.Token)
+	if err != nil {
+		return TokenReviewStatus{}, nil, err
+	}
+
+	// the API server cannot pass on a proof of possession
+	if claims.Cnf != nil {
+		return TokenReviewStatus{}, claims, errors.New("DPoP-bound tokens are not supported")
+	}
+
+	// tokens meant for other services must not be usable against the cluster
+	audience := viper.GetString("kubernetes.audience")
+	if audience == "" {
+		return TokenReviewStatus{}, claims, errors.New("kubernetes audience is not configured")
+	}
+	if !slices.Contains(claims.Audience, audience) {
+		return TokenReviewStatus{}, claims, errors.New("token is not issued for Kubernetes")
+	}
+
+	var audiences []string
+	for _, audience := range spec.Audiences {
+		if slices.Contains(claims.Audience, audience) {
+			audiences = append(audiences, audience)
+		}
+	}
+	if len(spec.Audiences) > 0 && len(audiences) == 0 {
+		return TokenReviewStatus{}, claims, errors.New("token is not issued for any of the requested audiences")
+	}
+
+	user := KubernetesUserInfo{
+		Username: claims.Subject,
+		Groups:   append(slices.Clone(claims.Tags), claims.Capabilities...),
+		Extra: map[string][]string{
+			tokenReviewExtraTokenID: {claims.ID},
+		},
+	}
+	if claims.DisplayName != "" {
+		user.Extra[tokenReviewExtraDisplayName] = []string{claims.DisplayName}
+	}
+	for act := claims.Act; act != nil; act = act.Act {
+		user.Extra[tokenReviewExtraActor] = append(user.Extra[tokenReviewExtraActor], act.Subject)
+	}
+
+	return TokenReviewStatus{
+		Authenticated: true,
+		User:          user,
+		Audiences:     audiences,
+	}, claims, nil
+}
@@ -0,0 +1,459 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+
+	"github.com/altacoda/tailbone/dpop"
+)
+
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+
+	AuditActionAuthorize    = "oidc.authorize"
+	AuditActionExchangeCode = "oidc.code"
+
+	// authorizationCodeTTL is how long an authorization code can be redeemed
+	authorizationCodeTTL = 60 * time.Second
+)
+
+// ErrInvalidAuthorizationCode is returned for unknown, expired or already used authorization codes
+var ErrInvalidAuthorizationCode = errors.New("invalid authorization code")
+
+// authorizationCode is what an authorization code stands for until it is redeemed
+type authorizationCode struct {
+	ClientID      string
+	RedirectURI   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	User          string
+	DisplayName   string
+	Node          string
+	Tags          []string
+	Capabilities  []string
+	AuthTime      time.Time
+	ExpiresAt     time.Time
+}
+
+// authorizationCodeStore keeps authorization codes in memory. Codes are short lived and
+// single use, so losing them on restart only means the user has to sign in again
+type authorizationCodeStore struct {
+	mu    sync.Mutex
+	codes map[string]*authorizationCode
+}
+
+func newAuthorizationCodeStore() *authorizationCodeStore {
+	return &authorizationCodeStore{
+		codes: make(map[string]*authorizationCode),
+	}
+}
+
+// Issue stores the authorization and returns the code standing for it
+func (s *authorizationCodeStore) Issue(authz *authorizationCode) (string, error) {
+	code, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for hash, existing := range s.codes {
+		if now.After(existing.ExpiresAt) {
+			delete(s.codes, hash)
+		}
+	}
+
+	authz.ExpiresAt = now.Add(authorizationCodeTTL)
+	s.codes[hashOpaqueToken(code)] = authz
+	return code, nil
+}
+
+// Redeem returns the authorization a code stands for. A code can only be redeemed once
+func (s *authorizationCodeStore) Redeem(code string) (*authorizationCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hash := hashOpaqueToken(code)
+	authz, ok := s.codes[hash]
+	if !ok {
+		return nil, ErrInvalidAuthorizationCode
+	}
+	delete(s.codes, hash)
+
+	if time.Now().After(authz.ExpiresAt) {
+		return nil, ErrInvalidAuthorizationCode
+	}
+	return authz, nil
+}
+
+// discoveryDocument is the OpenID Provider metadata (OpenID Connect Discovery 1.0 section 3)
+type discoveryDocument struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	DPoPSigningAlgValuesSupported     []string `json:"dpop_signing_alg_values_supported"`
+}
+
+// handleDiscovery serves the OpenID Provider metadata
+func (s *IssuerListener) handleDiscovery(w http.ResponseWriter, r *http.Request, _ zerolog.Logger) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	baseURL := issuerBaseURL(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(discoveryDocument{
+		Issuer:                            viper.GetString("keys.issuer"),
+		AuthorizationEndpoint:             baseURL + "/authorize",
+		TokenEndpoint:                     baseURL + "/token",
+		UserinfoEndpoint:                  baseURL + "/userinfo",
+		JWKSURI:                           baseURL + "/.well-known/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		ScopesSupported:                   []string{"openid", "profile", "email"},
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "name", "preferred_username", "email"},
+		GrantTypesSupported:               []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken, GrantTypeClientCredentials, GrantTypeTokenExchange},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		DPoPSigningAlgValuesSupported:     dpop.SigningMethods,
+	})
+}
+
+// handleJWKS serves the public keys tokens are signed with
+func (s *IssuerListener) handleJWKS(w http.ResponseWriter, r *http.Request, _ zerolog.Logger) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.issuer.GetJWKS(r.Context()))
+}
+
+// handleAuthorize implements the OIDC authorization endpoint. The browser is identified by
+// its Tailscale identity, so there is no login page: the user is redirected straight back
+// to the client with an authorization code
+func (s *IssuerListener) handleAuthorize(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID := r.FormValue("client_id")
+	redirectURI := r.FormValue("redirect_uri")
+	reqLogger = reqLogger.With().Str("client_id", clientID).Logger()
+
+	// Errors about the client or the redirect URI must not be redirected (RFC 6749 section 4.1.2.1)
+	client, err := s.clients.Get(ctx, clientID)
+	if err != nil {
+		reqLogger.Warn().Err(err).Msg("unknown client")
+		if errors.Is(err, ErrClientNotFound) {
+			http.Error(w, "unknown client_id", http.StatusBadRequest)
+		} else {
+			http.Error(w, "failed to look up client", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !client.AllowsRedirectURI(redirectURI) {
+		reqLogger.Warn().Str("redirect_uri", redirectURI).Msg("redirect URI is not registered")
+		http.Error(w, "redirect_uri is not registered for this client", http.StatusBadRequest)
+		return
+	}
+
+	state := r.FormValue("state")
+	redirectError := func(code, description string) {
+		params := url.Values{}
+		params.Set("error", code)
+		params.Set("error_description", description)
+		redirectToClient(w, r, redirectURI, state, params)
+	}
+
+	if r.FormValue("response_type") != "code" {
+		redirectError("unsupported_response_type", "only the code response type is supported")
+		return
+	}
+
+	if !client.AllowsGrantType(GrantTypeAuthorizationCode) {
+		redirectError("unauthorized_client", "client is not allowed to use the authorization code flow")
+		return
+	}
+
+	scope := r.FormValue("scope")
+	if !slices.Contains(strings.Fields(scope), "openid") {
+		redirectError("invalid_scope", "the openid scope is required")
+		return
+	}
+
+	codeChallenge := r.FormValue("code_challenge")
+	if codeChallenge != "" && r.FormValue("code_challenge_method") != "S256" {
+		redirectError("invalid_request", "code_challenge_method must be S256")
+		return
+	}
+	if codeChallenge == "" && client.Public() {
+		redirectError("invalid_request", "public clients must use PKCE")
+		return
+	}
+
+	who, err := s.client.WhoIs(ctx, r.RemoteAddr)
+	if err != nil {
+		reqLogger.Warn().Err(err).Msg("failed to identify user")
+		redirectError("access_denied", "browser is not a node of the tailnet")
+		return
+	}
+
+	identity := NewCallerIdentity(r.RemoteAddr, who)
+	event := AuditEvent{
+		Action:   AuditActionAuthorize,
+		Actor:    identity,
+		Subject:  identity.LoginName,
+		Audience: []string{clientID},
+	}
+
+	code, err := s.authorizationCodes.Issue(&authorizationCode{
+		ClientID:      clientID,
+		RedirectURI:   redirectURI,
+		Scope:         scope,
+		Nonce:         r.FormValue("nonce"),
+		CodeChallenge: codeChallenge,
+		User:          identity.LoginName,
+		DisplayName:   identity.DisplayName,
+		Node:          identity.NodeName,
+		Tags:          identity.Tags,
+		Capabilities:  identity.Capabilities,
+		AuthTime:      time.Now(),
+	})
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to issue authorization code")
+		s.auditor.Record(ctx, event.WithResult(err))
+		redirectError("server_error", "failed to issue authorization code")
+		return
+	}
+
+	s.auditor.Record(ctx, event.WithResult(nil))
+
+	reqLogger.Info().
+		Str("user", identity.LoginName).
+		Msg("authorized client")
+
+	params := url.Values{}
+	params.Set("code", code)
+	redirectToClient(w, r, redirectURI, state, params)
+}
+
+// authorizationCodeGrant redeems an authorization code for an ID token and an access token
+func (s *IssuerListener) authorizationCodeGrant(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	ctx := r.Context()
+
+	client, err := s.authenticateClient(r)
+	if err != nil || client == nil {
+		writeClientError(w, r, err, reqLogger)
+		return
+	}
+	if !client.AllowsGrantType(GrantTypeAuthorizationCode) {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "client is not allowed to use the authorization code grant")
+		return
+	}
+	clientID := client.ID
+	reqLogger = reqLogger.With().Str("client_id", clientID).Logger()
+
+	code := r.PostForm.Get("code")
+	if code == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "code is required")
+		return
+	}
+
+	authz, err := s.authorizationCodes.Redeem(code)
+	if err != nil {
+		reqLogger.Warn().Err(err).Msg("authorization code rejected")
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	event := AuditEvent{Action: AuditActionExchangeCode, Subject: authz.User, Audience: []string{clientID}}
+
+	if authz.ClientID != clientID || authz.RedirectURI != r.PostForm.Get("redirect_uri") {
+		err := errors.New("authorization code was issued to a different client or redirect URI")
+		reqLogger.Warn().Msg(err.Error())
+		s.auditor.Record(ctx, event.WithResult(err))
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	if authz.CodeChallenge != "" && !verifyCodeChallenge(authz.CodeChallenge, r.PostForm.Get("code_verifier")) {
+		err := errors.New("code_verifier does not match the code challenge")
+		reqLogger.Warn().Msg(err.Error())
+		s.auditor.Record(ctx, event.WithResult(err))
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	idToken, err := s.issuer.IssueIDToken(ctx, IDTokenRequest{
+		User:        authz.User,
+		DisplayName: authz.DisplayName,
+		ClientID:    clientID,
+		Nonce:       authz.Nonce,
+		AuthTime:    authz.AuthTime,
+	})
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to issue ID token")
+		s.auditor.Record(ctx, event.WithResult(err))
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to issue ID token")
+		return
+	}
+
+	token, err := s.issuer.IssueToken(ctx, TokenRequest{
+		User:         authz.User,
+		DisplayName:  authz.DisplayName,
+		Node:         authz.Node,
+		Tags:         authz.Tags,
+		Capabilities: authz.Capabilities,
+		Audience:     []string{clientID},
+	})
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to issue token")
+		s.auditor.Record(ctx, event.WithResult(err))
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to issue token")
+		return
+	}
+
+	event.KeyID = token.KeyID
+	event.TokenID = token.ID
+	s.auditor.Record(ctx, event.WithResult(nil))
+
+	reqLogger.Info().
+		Str("user", authz.User).
+		Str("jti", token.ID).
+		Msg("exchanged authorization code")
+
+	writeTokenResponse(w, tokenResponse{
+		AccessToken: token.Token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(time.Until(token.ExpiresAt).Seconds()),
+		IDToken:     idToken.Token,
+		Scope:       authz.Scope,
+	})
+}
+
+// handleUserInfo returns the profile claims of the user an access token was issued to
+func (s *IssuerListener) handleUserInfo(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scheme, tokenString, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if (scheme != "Bearer" && scheme != dpop.TokenType) || tokenString == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="tailbone"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := s.issuer.VerifyToken(r.Context(), tokenString)
+	if err == nil {
+		err = s.checkTokenBinding(r, scheme, tokenString, claims)
+	}
+	if err != nil {
+		reqLogger.Warn().Err(err).Msg("access token rejected")
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`%s realm="tailbone", error="invalid_token"`, scheme))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(NewUserInfo(claims.User, claims.DisplayName))
+}
+
+// checkTokenBinding requires DPoP-bound tokens to be presented with a proof of possession of their key
+func (s *IssuerListener) checkTokenBinding(r *http.Request, scheme, tokenString string, claims *TokenClaims) error {
+	if claims.Cnf == nil {
+		if scheme == dpop.TokenType {
+			return errors.New("token is not bound to a DPoP key")
+		}
+		return nil
+	}
+
+	if scheme != dpop.TokenType {
+		return errors.New("DPoP-bound token presented as a bearer token")
+	}
+
+	proof, err := s.dpop.Verify(r.Header.Get(dpop.HeaderName), r.Method, issuerBaseURL(r)+r.URL.Path, tokenString)
+	if err != nil {
+		return err
+	}
+
+	return dpop.CheckBinding(claims.Cnf.JKT, proof)
+}
+
+// verifyCodeChallenge checks a PKCE code verifier against an S256 code challenge (RFC 7636 section 4.6)
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if verifier == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:]) == challenge
+}
+
+// redirectToClient redirects the browser back to the client with the given response parameters
+func redirectToClient(w http.ResponseWriter, r *http.Request, redirectURI, state string, params url.Values) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if state != "" {
+		query.Set("state", state)
+	}
+	// identify the issuer of the response to prevent mix-up attacks (RFC 9207)
+	query.Set("iss", viper.GetString("keys.issuer"))
+	target.RawQuery = query.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// issuerBaseURL returns the URL the endpoints of the issuer are reachable at
+func issuerBaseURL(r *http.Request) string {
+	if baseURL := viper.GetString("oidc.baseUrl"); baseURL != "" {
+		return strings.TrimSuffix(baseURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
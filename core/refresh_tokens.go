@@ -0,0 +1,195 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+
+	"github.com/altacoda/tailbone/utils"
+)
+
+// ErrInvalidRefreshToken is returned when a refresh token is unknown, expired, reused or presented by the wrong node
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// RefreshToken is the stored record of an issued refresh token. Only a hash of the token is kept
+type RefreshToken struct {
+	Hash string `json:"hash"`
+	// FamilyID is shared by all tokens obtained by rotating the same original token
+	FamilyID string `json:"family_id"`
+	Subject  string `json:"sub"`
+	NodeKey  string `json:"node_key"`
+	// KeyThumbprint binds the token to the DPoP key of the client it was issued to, if set
+	KeyThumbprint string `json:"jkt,omitempty"`
+	IssuedAt      int64  `json:"issued_at"`
+	ExpiresAt     int64  `json:"expires_at"`
+	// Used is set once the token has been rotated, so a replay can be detected
+	Used bool `json:"used"`
+}
+
+// RefreshTokenStore persists refresh tokens in a local file
+type RefreshTokenStore struct {
+	path   string
+	logger zerolog.Logger
+	mu     sync.Mutex
+}
+
+// NewRefreshTokenStore creates a refresh token store backed by the configured file
+func NewRefreshTokenStore() *RefreshTokenStore {
+	path := viper.GetString("refresh.file")
+	if path == "" {
+		path = filepath.Join(viper.GetString("keys.dir"), "refresh_tokens.json")
+	}
+
+	return &RefreshTokenStore{
+		path:   path,
+		logger: utils.GetLogger("refresh-tokens"),
+	}
+}
+
+// Issue creates a new refresh token bound to a subject, a Tailscale node key and, if keyThumbprint
+// is set, a DPoP key. An empty familyID starts a new family
+func (s *RefreshTokenStore) Issue(_ context.Context, subject, nodeKey, keyThumbprint, familyID string) (string, *RefreshToken, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if familyID == "" {
+		familyID = uuid.NewString()
+	}
+
+	now := time.Now()
+	record := RefreshToken{
+		Hash:          hashOpaqueToken(token),
+		FamilyID:      familyID,
+		Subject:       subject,
+		NodeKey:       nodeKey,
+		KeyThumbprint: keyThumbprint,
+		IssuedAt:      now.Unix(),
+		ExpiresAt:     now.Add(viper.GetDuration("refresh.expiry")).Unix(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.load()
+	if err != nil {
+		return "", nil, err
+	}
+
+	records = append(records, record)
+	if err := s.save(records); err != nil {
+		return "", nil, err
+	}
+
+	s.logger.Debug().Str("sub", subject).Str("family_id", familyID).Msg("issued refresh token")
+	return token, &record, nil
+}
+
+// Use marks a refresh token as used and returns its record. Presenting a token that was
+// already used revokes its whole family, as the token has most likely been stolen
+func (s *RefreshTokenStore) Use(_ context.Context, token, nodeKey string) (*RefreshToken, error) {
+	hash := hashOpaqueToken(token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, record := range records {
+		if record.Hash != hash {
+			continue
+		}
+
+		if record.Used {
+			s.logger.Warn().Str("sub", record.Subject).Str("family_id", record.FamilyID).Msg("refresh token reused. revoking token family")
+			if err := s.save(removeFamily(records, record.FamilyID)); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%w: token has already been used", ErrInvalidRefreshToken)
+		}
+
+		if record.ExpiresAt <= time.Now().Unix() {
+			return nil, fmt.Errorf("%w: token has expired", ErrInvalidRefreshToken)
+		}
+
+		if record.NodeKey != nodeKey {
+			s.logger.Warn().Str("sub", record.Subject).Str("family_id", record.FamilyID).Msg("refresh token presented by a different node")
+			return nil, fmt.Errorf("%w: token is bound to a different node", ErrInvalidRefreshToken)
+		}
+
+		records[i].Used = true
+		if err := s.save(records); err != nil {
+			return nil, err
+		}
+
+		return &record, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown token", ErrInvalidRefreshToken)
+}
+
+func (s *RefreshTokenStore) load() ([]RefreshToken, error) {
+	var records []RefreshToken
+	if err := utils.ReadJSONFile(s.path, &records); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		s.logger.Error().Err(err).Str("file", s.path).Msg("failed to load refresh tokens")
+		return nil, fmt.Errorf("failed to load refresh tokens: %w", err)
+	}
+
+	return records, nil
+}
+
+// save drops expired tokens and writes the rest to disk
+func (s *RefreshTokenStore) save(records []RefreshToken) error {
+	records = pruneExpired(records, time.Now(), func(r RefreshToken) int64 { return r.ExpiresAt })
+	if err := utils.WriteJSONFile(s.path, records, 0600); err != nil {
+		s.logger.Error().Err(err).Str("file", s.path).Msg("failed to save refresh tokens")
+		return fmt.Errorf("failed to save refresh tokens: %w", err)
+	}
+
+	return nil
+}
+
+func removeFamily(records []RefreshToken, familyID string) []RefreshToken {
+	remaining := make([]RefreshToken, 0, len(records))
+	for _, record := range records {
+		if record.FamilyID != familyID {
+			remaining = append(remaining, record)
+		}
+	}
+
+	return remaining
+}
+
+// newOpaqueToken returns a random URL-safe token
+func newOpaqueToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,248 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+
+	"github.com/altacoda/tailbone/utils"
+)
+
+// RevocationList is the published list of revoked tokens and subjects
+type RevocationList struct {
+	UpdatedAt int64            `json:"updated_at"`
+	Tokens    []RevokedToken   `json:"tokens"`
+	Subjects  []RevokedSubject `json:"subjects"`
+}
+
+// RevokedToken revokes a single token by its jti
+type RevokedToken struct {
+	ID        string `json:"jti"`
+	RevokedAt int64  `json:"revoked_at"`
+	// ExpiresAt is when the entry can be dropped because every token it covers has expired
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// RevokedSubject revokes every token of a subject issued at or before RevokedAt
+type RevokedSubject struct {
+	Subject   string `json:"sub"`
+	RevokedAt int64  `json:"revoked_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// IsRevoked returns true if the token with the given claims has been revoked
+func (l *RevocationList) IsRevoked(claims *TokenClaims) bool {
+	for _, token := range l.Tokens {
+		if claims.ID != "" && token.ID == claims.ID {
+			return true
+		}
+	}
+
+	for _, subject := range l.Subjects {
+		if subject.Subject != claims.Subject {
+			continue
+		}
+		if claims.IssuedAt == nil || claims.IssuedAt.Unix() <= subject.RevokedAt {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RevocationStore persists the revocation list in a local file
+type RevocationStore struct {
+	path    string
+	logger  zerolog.Logger
+	mu      sync.Mutex
+	list    RevocationList
+	modTime time.Time
+}
+
+// NewRevocationStore creates a revocation store backed by the configured revocations file
+func NewRevocationStore() *RevocationStore {
+	path := viper.GetString("revocations.file")
+	if path == "" {
+		path = filepath.Join(viper.GetString("keys.dir"), "revocations.json")
+	}
+
+	return &RevocationStore{
+		path:   path,
+		logger: utils.GetLogger("revocations"),
+	}
+}
+
+// List returns the current revocation list, reloading it if the file changed
+func (s *RevocationStore) List(_ context.Context) (*RevocationList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	list := s.list
+	return &list, nil
+}
+
+// IsRevoked returns true if the token with the given claims has been revoked
+func (s *RevocationStore) IsRevoked(ctx context.Context, claims *TokenClaims) (bool, error) {
+	list, err := s.List(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return list.IsRevoked(claims), nil
+}
+
+// RevokeToken adds a token to the revocation list
+func (s *RevocationStore) RevokeToken(_ context.Context, jti string) (*RevokedToken, *RevocationList, error) {
+	if jti == "" {
+		return nil, nil, fmt.Errorf("jti is required")
+	}
+
+	now := time.Now()
+	revoked := RevokedToken{
+		ID:        jti,
+		RevokedAt: now.Unix(),
+		ExpiresAt: now.Add(maxTokenLifetime()).Unix(),
+	}
+
+	list, err := s.update(func(list *RevocationList) {
+		for i, token := range list.Tokens {
+			if token.ID == jti {
+				list.Tokens[i] = revoked
+				return
+			}
+		}
+		list.Tokens = append(list.Tokens, revoked)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.logger.Info().Str("jti", jti).Msg("revoked token")
+	return &revoked, list, nil
+}
+
+// RevokeSubject revokes every token issued to a subject up to now
+func (s *RevocationStore) RevokeSubject(_ context.Context, subject string) (*RevokedSubject, *RevocationList, error) {
+	if subject == "" {
+		return nil, nil, fmt.Errorf("subject is required")
+	}
+
+	now := time.Now()
+	revoked := RevokedSubject{
+		Subject:   subject,
+		RevokedAt: now.Unix(),
+		ExpiresAt: now.Add(maxTokenLifetime()).Unix(),
+	}
+
+	list, err := s.update(func(list *RevocationList) {
+		for i, entry := range list.Subjects {
+			if entry.Subject == subject {
+				list.Subjects[i] = revoked
+				return
+			}
+		}
+		list.Subjects = append(list.Subjects, revoked)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.logger.Info().Str("sub", subject).Msg("revoked subject")
+	return &revoked, list, nil
+}
+
+// update applies fn to the revocation list, drops expired entries and saves the result
+func (s *RevocationStore) update(fn func(list *RevocationList)) (*RevocationList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	list := RevocationList{
+		Tokens:   append([]RevokedToken{}, s.list.Tokens...),
+		Subjects: append([]RevokedSubject{}, s.list.Subjects...),
+	}
+	fn(&list)
+
+	now := time.Now()
+	list.UpdatedAt = now.Unix()
+	list.Tokens = pruneExpired(list.Tokens, now, func(t RevokedToken) int64 { return t.ExpiresAt })
+	list.Subjects = pruneExpired(list.Subjects, now, func(s RevokedSubject) int64 { return s.ExpiresAt })
+
+	if err := utils.WriteJSONFile(s.path, list, 0600); err != nil {
+		s.logger.Error().Err(err).Str("file", s.path).Msg("failed to save revocation list")
+		return nil, fmt.Errorf("failed to save revocation list: %w", err)
+	}
+
+	s.list = list
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+
+	return &list, nil
+}
+
+// load reads the revocation list from disk if it changed since it was last read
+func (s *RevocationStore) load() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.list = RevocationList{Tokens: []RevokedToken{}, Subjects: []RevokedSubject{}}
+		s.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read revocation list: %w", err)
+	}
+
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	var list RevocationList
+	if err := utils.ReadJSONFile(s.path, &list); err != nil {
+		s.logger.Error().Err(err).Str("file", s.path).Msg("failed to load revocation list")
+		return fmt.Errorf("failed to load revocation list: %w", err)
+	}
+
+	s.list = list
+	s.modTime = info.ModTime()
+	s.logger.Debug().
+		Int("tokens", len(list.Tokens)).
+		Int("subjects", len(list.Subjects)).
+		Msg("loaded revocation list")
+	return nil
+}
+
+// maxTokenLifetime is how long a revocation entry has to be kept to cover every token it applies to
+func maxTokenLifetime() time.Duration {
+	lifetime := viper.GetDuration("keys.expiry")
+	if refresh := viper.GetDuration("refresh.expiry"); refresh > lifetime {
+		lifetime = refresh
+	}
+
+	return lifetime
+}
+
+func pruneExpired[T any](entries []T, now time.Time, expiresAt func(T) int64) []T {
+	remaining := make([]T, 0, len(entries))
+	for _, entry := range entries {
+		if expiresAt(entry) > now.Unix() {
+			remaining = append(remaining, entry)
+		}
+	}
+
+	return remaining
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+// DefaultSPIFFEIDTemplate maps tagged nodes to /tag/<tag> and users to /user/<domain>/<name>
+const DefaultSPIFFEIDTemplate = `{{if .Tag}}/tag/{{.Tag}}{{else if .Domain}}/user/{{.Domain}}/{{.User}}{{else}}/user/{{.User}}{{end}}`
+
+// spiffeBundleRefreshHint tells bundle consumers how often to poll the trust bundle
+const spiffeBundleRefreshHint = 5 * time.Minute
+
+var (
+	// trust domain names are lowercase letters, digits, dots, dashes and underscores (SPIFFE ID spec section 2.1)
+	spiffeTrustDomainPattern = regexp.MustCompile(`^[a-z0-9._-]+$`)
+	// path segments are letters, digits, dots, dashes and underscores (SPIFFE ID spec section 2.2)
+	spiffePathSegmentPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+)
+
+// SPIFFEIDTemplate derives SPIFFE IDs from Tailscale identities
+type SPIFFEIDTemplate struct {
+	trustDomain string
+	tmpl        *template.Template
+}
+
+// spiffeTemplateData is what the SPIFFE ID template is executed with
+type spiffeTemplateData struct {
+	LoginName string   // Tailscale login name, e.g. alice@example.com
+	User      string   // Login name up to the @, e.g. alice
+	Domain    string   // Login name after the @, e.g. example.com
+	Node      string   // Host name of the node, e.g. laptop
+	Tags      []string // Tags of the node without the tag: prefix
+	Tag       string   // First tag of the node without the tag: prefix
+}
+
+// NewSPIFFEIDTemplate parses the template SPIFFE ID paths are rendered from
+func NewSPIFFEIDTemplate(trustDomain, text string) (*SPIFFEIDTemplate, error) {
+	if !spiffeTrustDomainPattern.MatchString(trustDomain) {
+		return nil, fmt.Errorf("invalid SPIFFE trust domain %q", trustDomain)
+	}
+
+	if text == "" {
+		text = DefaultSPIFFEIDTemplate
+	}
+
+	tmpl, err := template.New("spiffe-id").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SPIFFE ID template: %w", err)
+	}
+
+	return &SPIFFEIDTemplate{
+		trustDomain: trustDomain,
+		tmpl:        tmpl,
+	}, nil
+}
+
+// NewSPIFFEIDTemplateFromConfig returns the configured SPIFFE ID template, or nil if
+// JWT-SVID issuance is not enabled
+func NewSPIFFEIDTemplateFromConfig() (*SPIFFEIDTemplate, error) {
+	trustDomain := viper.GetString("spiffe.trustDomain")
+	if trustDomain == "" {
+		return nil, nil
+	}
+
+	return NewSPIFFEIDTemplate(trustDomain, viper.GetString("spiffe.template"))
+}
+
+// TrustDomain returns the trust domain SPIFFE IDs are issued in
+func (t *SPIFFEIDTemplate) TrustDomain() string {
+	return t.trustDomain
+}
+
+// ID renders the SPIFFE ID of the subject of a token request
+func (t *SPIFFEIDTemplate) ID(req TokenRequest) (string, error) {
+	data := spiffeTemplateData{
+		LoginName: req.User,
+		User:      req.User,
+	}
+	if user, domain, ok := strings.Cut(req.User, "@"); ok {
+		data.User = user
+		data.Domain = domain
+	}
+	data.Node, _, _ = strings.Cut(req.Node, ".")
+	for _, tag := range req.Tags {
+		data.Tags = append(data.Tags, strings.TrimPrefix(tag, "tag:"))
+	}
+	if len(data.Tags) > 0 {
+		data.Tag = data.Tags[0]
+	}
+
+	var path strings.Builder
+	if err := t.tmpl.Execute(&path, data); err != nil {
+		return "", fmt.Errorf("failed to render SPIFFE ID: %w", err)
+	}
+
+	if err := validateSPIFFEPath(path.String()); err != nil {
+		return "", err
+	}
+
+	return "spiffe://" + t.trustDomain + path.String(), nil
+}
+
+// validateSPIFFEPath checks a rendered path against the SPIFFE ID spec
+func validateSPIFFEPath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("invalid SPIFFE ID path %q: must start with /", path)
+	}
+
+	for _, segment := range strings.Split(path[1:], "/") {
+		if segment == "." || segment == ".." || !spiffePathSegmentPattern.MatchString(segment) {
+			return fmt.Errorf("invalid SPIFFE ID path %q: segments must be non-empty and only contain letters, digits, '.', '-' and '_'", path)
+		}
+	}
+
+	return nil
+}
+
+// handleSPIFFEBundle serves the signing keys as a SPIFFE trust bundle, which is a JWKS
+// whose keys are marked for JWT-SVID verification (SPIFFE Trust Domain and Bundle spec section 4)
+func (s *IssuerListener) handleSPIFFEBundle(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.spiffe == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := json.Marshal(s.issuer.GetJWKS(r.Context()))
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to marshal key set")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var bundle struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		reqLogger.Error().Err(err).Msg("failed to read key set")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, key := range bundle.Keys {
+		key["use"] = "jwt-svid"
+	}
+	if bundle.Keys == nil {
+		bundle.Keys = []map[string]interface{}{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys":                bundle.Keys,
+		"spiffe_refresh_hint": int64(spiffeBundleRefreshHint.Seconds()),
+	})
+}
@@ -0,0 +1,221 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/altacoda/tailbone/utils"
+)
+
+const AuditActionIssueSSHCertificate = "ssh.issue"
+
+// maxSSHPublicKeySize limits the size of SSH public keys sent for signing
+const maxSSHPublicKeySize = 16 << 10
+
+// sshCertificateExtensions are the permissions granted by user certificates, the same
+// ones ssh-keygen grants by default
+var sshCertificateExtensions = map[string]string{
+	"permit-X11-forwarding":   "",
+	"permit-agent-forwarding": "",
+	"permit-port-forwarding":  "",
+	"permit-pty":              "",
+	"permit-user-rc":          "",
+}
+
+// sshCertificateResponse is the response of the SSH issuance endpoint
+type sshCertificateResponse struct {
+	Certificate string   `json:"certificate"` // certificate in authorized_keys format, e.g. for id_ed25519-cert.pub
+	CA          string   `json:"ca"`          // public key of the issuing CA in authorized_keys format
+	Serial      uint64   `json:"serial"`
+	Principals  []string `json:"principals"`
+	ExpiresAt   int64    `json:"expires_at"`
+}
+
+// handleIssueSSH signs an SSH public key with the SSH CA. The principals of the certificate
+// are derived from the caller's Tailscale identity
+func (s *IssuerListener) handleIssueSSH(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSSHPublicKeySize))
+	if err != nil {
+		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	publicKey, err := parseSSHPublicKey(body)
+	if err != nil {
+		reqLogger.Warn().Err(err).Msg("invalid SSH public key")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	who, err := s.client.WhoIs(ctx, r.RemoteAddr)
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to identify user")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	identity := NewCallerIdentity(r.RemoteAddr, who)
+	event := AuditEvent{Action: AuditActionIssueSSHCertificate, Actor: identity, Subject: identity.LoginName}
+
+	ca, err := utils.LatestSSHCA(ctx, s.sshCA)
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to load SSH CA")
+		s.auditor.Record(ctx, event.WithResult(err))
+		http.Error(w, "no SSH CA key available", http.StatusServiceUnavailable)
+		return
+	}
+	event.KeyID = ca.KeyID
+
+	cert, err := newSSHUserCertificate(identity, publicKey)
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to create SSH certificate")
+		s.auditor.Record(ctx, event.WithResult(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	event.TokenID = fmt.Sprintf("%d", cert.Serial)
+
+	if err := cert.SignCert(rand.Reader, ca.Signer); err != nil {
+		reqLogger.Error().Err(err).Msg("failed to sign SSH certificate")
+		s.auditor.Record(ctx, event.WithResult(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.auditor.Record(ctx, event.WithResult(nil))
+
+	reqLogger.Info().
+		Str("user", identity.LoginName).
+		Str("kid", ca.KeyID).
+		Uint64("serial", cert.Serial).
+		Strs("principals", cert.ValidPrincipals).
+		Msg("issued SSH certificate")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(sshCertificateResponse{
+		Certificate: string(utils.MarshalSSHPublicKey(cert, cert.KeyId)),
+		CA:          string(utils.MarshalSSHPublicKey(ca.Signer.PublicKey(), ca.KeyID)),
+		Serial:      cert.Serial,
+		Principals:  cert.ValidPrincipals,
+		ExpiresAt:   int64(cert.ValidBefore),
+	})
+}
+
+// handleSSHCAKeys serves the public keys of the SSH CA keys for sshd's TrustedUserCAKeys
+func (s *IssuerListener) handleSSHCAKeys(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keys, err := utils.SSHCAPublicKeys(r.Context(), s.sshCA)
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to load SSH CA keys")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(keys)
+}
+
+// newSSHUserCertificate describes the unsigned user certificate of a Tailscale identity
+func newSSHUserCertificate(identity *CallerIdentity, key ssh.PublicKey) (*ssh.Certificate, error) {
+	principals := sshPrincipals(identity)
+	if len(principals) == 0 {
+		return nil, errors.New("caller has no SSH principals")
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	keyID := identity.LoginName
+	if len(identity.Tags) > 0 {
+		keyID, _, _ = strings.Cut(strings.TrimSuffix(identity.NodeName, "."), ".")
+	}
+
+	now := time.Now()
+	return &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		// allow for a little clock skew between the client and the server
+		ValidAfter:  uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore: uint64(now.Add(viper.GetDuration("ssh.expiry")).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: maps.Clone(sshCertificateExtensions),
+		},
+	}, nil
+}
+
+// sshPrincipals returns the principals of a Tailscale identity. Users get their full login name,
+// plus its local part if the domain is one of ssh.domains, tagged nodes their tags without the
+// tag: prefix
+func sshPrincipals(identity *CallerIdentity) []string {
+	if len(identity.Tags) > 0 {
+		principals := make([]string, 0, len(identity.Tags))
+		for _, tag := range identity.Tags {
+			principals = append(principals, strings.TrimPrefix(tag, "tag:"))
+		}
+		return principals
+	}
+
+	if identity.LoginName == "" {
+		return nil
+	}
+
+	// a local part is only unique within a domain, alice@gmail.com must not log in as alice of example.com
+	user, domain, ok := strings.Cut(identity.LoginName, "@")
+	if !ok || user == "" || !slices.ContainsFunc(viper.GetStringSlice("ssh.domains"), func(allowed string) bool {
+		return strings.EqualFold(allowed, domain)
+	}) {
+		return []string{identity.LoginName}
+	}
+	return []string{user, identity.LoginName}
+}
+
+// parseSSHPublicKey parses and checks a public key in authorized_keys format
+func parseSSHPublicKey(data []byte) (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH public key: %w", err)
+	}
+
+	if _, ok := key.(*ssh.Certificate); ok {
+		return nil, errors.New("expected a public key, got a certificate")
+	}
+
+	if cryptoKey, ok := key.(ssh.CryptoPublicKey); ok {
+		if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+	}
+
+	return key, nil
+}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+
+	"github.com/altacoda/tailbone/dpop"
+)
+
+// Headers carrying the identity of an authenticated caller to protected services
+const (
+	HeaderUser        = "x-tailbone-user"
+	HeaderSubject     = "x-tailbone-subject"
+	HeaderDisplayName = "x-tailbone-display-name"
+	HeaderTags        = "x-tailbone-tags"
+	HeaderTokenID     = "x-tailbone-token-id"
+)
+
+var identityHeaders = []string{HeaderUser, HeaderSubject, HeaderDisplayName, HeaderTags, HeaderTokenID}
+
+var errMissingToken = errors.New("missing bearer token")
+
+// Headers proxies use to pass the original request to a forward-auth endpoint
+const (
+	headerForwardedMethod = "X-Forwarded-Method"
+	headerForwardedProto  = "X-Forwarded-Proto"
+	headerForwardedHost   = "X-Forwarded-Host"
+	headerForwardedURI    = "X-Forwarded-Uri"
+)
+
+// presentedToken is an access token as presented with a request to a protected service
+type presentedToken struct {
+	Authorization string // Authorization header, Bearer or DPoP scheme
+	Proof         string // DPoP header, if any
+	Method        string // HTTP method of the request
+	URL           string // URL of the request without query, for DPoP proofs
+}
+
+// verifyPresentedToken verifies an access token presented to a protected service. DPoP-bound
+// tokens must come with a proof of possession of their key
+func verifyPresentedToken(ctx context.Context, issuer Issuer, verifier *dpop.Verifier, presented presentedToken) (*TokenClaims, error) {
+	scheme, tokenString, _ := strings.Cut(presented.Authorization, " ")
+	if (scheme != "Bearer" && scheme != dpop.TokenType) || tokenString == "" {
+		return nil, errMissingToken
+	}
+
+	claims, err := issuer.VerifyToken(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Cnf == nil {
+		if scheme == dpop.TokenType {
+			return nil, errors.New("token is not bound to a DPoP key")
+		}
+		return claims, nil
+	}
+
+	if scheme != dpop.TokenType {
+		return nil, errors.New("DPoP-bound token presented as a bearer token")
+	}
+
+	proof, err := verifier.Verify(presented.Proof, presented.Method, presented.URL, tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dpop.CheckBinding(claims.Cnf.JKT, proof); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkAudience requires a token to be issued for one of the audiences, if any are given
+func checkAudience(claims *TokenClaims, audiences []string) error {
+	if len(audiences) == 0 {
+		return nil
+	}
+
+	for _, audience := range audiences {
+		if slices.Contains(claims.Audience, strings.TrimSpace(audience)) {
+			return nil
+		}
+	}
+	return errors.New("token is not issued for this service")
+}
+
+// identityHeaderValues returns the identity headers passed to protected services, empty values included
+func identityHeaderValues(claims *TokenClaims) map[string]string {
+	return map[string]string{
+		HeaderUser:        claims.User,
+		HeaderSubject:     claims.Subject,
+		HeaderDisplayName: claims.DisplayName,
+		HeaderTags:        strings.Join(claims.Tags, ","),
+		HeaderTokenID:     claims.ID,
+	}
+}
+
+// handleVerify is a forward-auth endpoint for nginx auth_request, Traefik ForwardAuth and Caddy
+// forward_auth. It answers 200 with the identity of the caller in headers if the request carries
+// a valid token, or, with WhoIs identification enabled and no token, comes from a tailnet node.
+// Otherwise it answers 401, or 403 if the token is not issued for one of the audience parameters
+func (s *IssuerListener) handleVerify(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	ctx := r.Context()
+
+	var claims *TokenClaims
+	var err error
+	if r.Header.Get("Authorization") == "" && viper.GetBool("verify.whois") {
+		claims, err = s.identifyForwardedClient(ctx, r)
+	} else {
+		claims, err = verifyPresentedToken(ctx, s.issuer, s.dpop, forwardedToken(r))
+	}
+	if err != nil {
+		reqLogger.Warn().Err(err).Msg("request not authenticated")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="tailbone"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := checkAudience(claims, r.URL.Query()["audience"]); err != nil {
+		reqLogger.Warn().Err(err).Str("sub", claims.Subject).Msg("request not authorized")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	for name, value := range identityHeaderValues(claims) {
+		if value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// identifyForwardedClient identifies the client of a proxied request by WhoIs. The proxy passes
+// the client address in the configured header; with X-Forwarded-For, the last address is the one
+// the proxy added itself
+func (s *IssuerListener) identifyForwardedClient(ctx context.Context, r *http.Request) (*TokenClaims, error) {
+	values := strings.Split(r.Header.Get(viper.GetString("verify.clientIPHeader")), ",")
+	addr := strings.TrimSpace(values[len(values)-1])
+	if addr == "" {
+		return nil, errMissingToken
+	}
+
+	who, err := s.client.WhoIs(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to identify client %s: %w", addr, err)
+	}
+
+	identity := NewCallerIdentity(addr, who)
+	claims := &TokenClaims{
+		User:        identity.LoginName,
+		DisplayName: identity.DisplayName,
+		Tags:        identity.Tags,
+	}
+	claims.Subject = identity.LoginName
+	return claims, nil
+}
+
+// forwardedToken returns the token of a request passed on by a forward-auth proxy. The original
+// method and URL, needed for DPoP proofs, are taken from the X-Forwarded-* headers
+func forwardedToken(r *http.Request) presentedToken {
+	path, _, _ := strings.Cut(r.Header.Get(headerForwardedURI), "?")
+	return presentedToken{
+		Authorization: r.Header.Get("Authorization"),
+		Proof:         r.Header.Get(dpop.HeaderName),
+		Method:        r.Header.Get(headerForwardedMethod),
+		URL:           fmt.Sprintf("%s://%s%s", r.Header.Get(headerForwardedProto), r.Header.Get(headerForwardedHost), path),
+	}
+}
@@ -0,0 +1,217 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+
+	"github.com/altacoda/tailbone/utils"
+)
+
+const AuditActionIssueCertificate = "x509.issue"
+
+// maxCSRSize limits the size of certificate signing requests
+const maxCSRSize = 64 << 10
+
+// certificateResponse is the response of the X.509 issuance endpoint
+type certificateResponse struct {
+	Certificate string `json:"certificate"` // PEM encoded client certificate
+	CA          string `json:"ca"`          // PEM encoded certificate of the issuing CA
+	Serial      string `json:"serial"`
+	ExpiresAt   int64  `json:"expires_at"`
+}
+
+// handleIssueX509 signs a certificate signing request with the X.509 CA. Only the public key of
+// the request is used: the subject and SANs of the certificate encode the caller's Tailscale identity
+func (s *IssuerListener) handleIssueX509(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCSRSize))
+	if err != nil {
+		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	csr, err := parseCSR(body)
+	if err != nil {
+		reqLogger.Warn().Err(err).Msg("invalid certificate signing request")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	who, err := s.client.WhoIs(ctx, r.RemoteAddr)
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to identify user")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	identity := NewCallerIdentity(r.RemoteAddr, who)
+	event := AuditEvent{Action: AuditActionIssueCertificate, Actor: identity, Subject: identity.LoginName}
+
+	ca, err := utils.LatestX509CA(ctx, s.x509CA)
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to load X.509 CA")
+		s.auditor.Record(ctx, event.WithResult(err))
+		http.Error(w, "no X.509 CA key available", http.StatusServiceUnavailable)
+		return
+	}
+	event.KeyID = ca.KeyID
+
+	template, err := s.clientCertificateTemplate(identity, ca.Certificate.NotAfter)
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to create certificate template")
+		s.auditor.Record(ctx, event.WithResult(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	event.TokenID = template.SerialNumber.Text(16)
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, csr.PublicKey, ca.Signer)
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to sign certificate")
+		s.auditor.Record(ctx, event.WithResult(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.auditor.Record(ctx, event.WithResult(nil))
+
+	reqLogger.Info().
+		Str("user", identity.LoginName).
+		Str("kid", ca.KeyID).
+		Str("serial", event.TokenID).
+		Msg("issued client certificate")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(certificateResponse{
+		Certificate: string(utils.EncodeCertificatesPEM(der)),
+		CA:          string(utils.EncodeCertificatesPEM(ca.Certificate.Raw)),
+		Serial:      event.TokenID,
+		ExpiresAt:   template.NotAfter.Unix(),
+	})
+}
+
+// handleX509Bundle serves the certificates of the X.509 CA keys
+func (s *IssuerListener) handleX509Bundle(w http.ResponseWriter, r *http.Request, reqLogger zerolog.Logger) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bundle, err := utils.X509CABundle(r.Context(), s.x509CA)
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("failed to load X.509 CA bundle")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(bundle)
+}
+
+// clientCertificateTemplate describes the client certificate of a Tailscale identity. Users get
+// their login name as common name and email SAN, tagged nodes their host name as common name
+// and their tags as organizational units. The node name is added as DNS SAN and, when JWT-SVIDs
+// are enabled, the SPIFFE ID as URI SAN
+func (s *IssuerListener) clientCertificateTemplate(identity *CallerIdentity, caNotAfter time.Time) (*x509.Certificate, error) {
+	serial, err := utils.NewCertificateSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(viper.GetDuration("x509.expiry"))
+	if caNotAfter.Before(notAfter) {
+		notAfter = caNotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         identity.LoginName,
+			OrganizationalUnit: identity.Tags,
+		},
+		// allow for a little clock skew between the client and the server
+		NotBefore:   now.Add(-time.Minute),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	nodeName := strings.TrimSuffix(identity.NodeName, ".")
+	if len(identity.Tags) > 0 {
+		template.Subject.CommonName, _, _ = strings.Cut(nodeName, ".")
+	} else if strings.Contains(identity.LoginName, "@") {
+		template.EmailAddresses = []string{identity.LoginName}
+	}
+	if nodeName != "" {
+		template.DNSNames = []string{nodeName}
+	}
+
+	if s.spiffe != nil {
+		id, err := s.spiffe.ID(TokenRequest{User: identity.LoginName, Node: identity.NodeName, Tags: identity.Tags})
+		if err != nil {
+			return nil, err
+		}
+		uri, err := url.Parse(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SPIFFE ID: %w", err)
+		}
+		template.URIs = []*url.URL{uri}
+	}
+
+	return template, nil
+}
+
+// parseCSR parses and checks a PEM or DER encoded certificate signing request
+func parseCSR(data []byte) (*x509.CertificateRequest, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST" {
+			return nil, fmt.Errorf("expected a CERTIFICATE REQUEST PEM block, got %s", block.Type)
+		}
+		data = block.Bytes
+	}
+
+	csr, err := x509.ParseCertificateRequest(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate signing request: %w", err)
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate signing request signature: %w", err)
+	}
+
+	switch key := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+
+	return csr, nil
+}
@@ -0,0 +1,237 @@
+// Package dpop verifies DPoP proofs (RFC 9449) presented with sender-constrained Tailbone tokens.
+//
+// A token issued with a DPoP proof carries the thumbprint of the client's public key in its
+// cnf.jkt claim. Relying parties accept such a token only together with a fresh proof signed
+// by the matching private key:
+//
+//	verifier := dpop.NewVerifier(dpop.DefaultMaxAge)
+//	proof, err := verifier.VerifyRequest(r, accessToken)
+//	if err != nil { ... }
+//	if err := dpop.CheckBinding(claims.Cnf.JKT, proof); err != nil { ... }
+package dpop
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+const (
+	// HeaderName is the HTTP header carrying the DPoP proof
+	HeaderName = "DPoP"
+	// TokenType is the token type of DPoP-bound access tokens, used in the Authorization header
+	TokenType = "DPoP"
+	// ProofType is the typ header of DPoP proof JWTs
+	ProofType = "dpop+jwt"
+
+	// DefaultMaxAge is how old a proof can be before it is rejected
+	DefaultMaxAge = 5 * time.Minute
+)
+
+// ErrInvalidProof is returned for proofs that are malformed, badly signed, stale, replayed or
+// do not match the request
+var ErrInvalidProof = errors.New("invalid DPoP proof")
+
+// SigningMethods are the algorithms accepted for DPoP proofs. Symmetric algorithms are not allowed
+var SigningMethods = []string{"RS256", "PS256", "ES256", "ES384", "EdDSA"}
+
+// Proof is a verified DPoP proof
+type Proof struct {
+	ID       string
+	Method   string
+	URL      string
+	IssuedAt time.Time
+	// AccessTokenHash is the ath claim, set when the proof is presented with an access token
+	AccessTokenHash string
+	Key             jwk.Key
+	// Thumbprint is the base64url encoded SHA-256 JWK thumbprint (RFC 7638) of Key
+	Thumbprint string
+}
+
+type proofClaims struct {
+	jwt.RegisteredClaims
+	Method          string `json:"htm"`
+	URL             string `json:"htu"`
+	AccessTokenHash string `json:"ath,omitempty"`
+}
+
+// Verifier verifies DPoP proofs and rejects replayed ones
+type Verifier struct {
+	maxAge time.Duration
+	mu     sync.Mutex
+	seen   map[string]time.Time
+}
+
+// NewVerifier creates a verifier accepting proofs up to maxAge old
+func NewVerifier(maxAge time.Duration) *Verifier {
+	return &Verifier{
+		maxAge: maxAge,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// VerifyRequest verifies the DPoP proof of an HTTP request. accessToken is the token
+// presented with the request, or empty if the request is for a new token
+func (v *Verifier) VerifyRequest(r *http.Request, accessToken string) (*Proof, error) {
+	values := r.Header.Values(HeaderName)
+	if len(values) != 1 {
+		return nil, fmt.Errorf("%w: exactly one %s header is required", ErrInvalidProof, HeaderName)
+	}
+
+	return v.Verify(values[0], r.Method, RequestURL(r), accessToken)
+}
+
+// Verify verifies a DPoP proof for the given HTTP method and URL. accessToken is the token
+// the proof is presented with, or empty if the proof is presented to get a new token
+func (v *Verifier) Verify(proof, method, requestURL, accessToken string) (*Proof, error) {
+	var key jwk.Key
+	claims := &proofClaims{}
+	_, err := jwt.ParseWithClaims(proof, claims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ != ProofType {
+			return nil, fmt.Errorf("typ must be %s", ProofType)
+		}
+
+		raw, ok := token.Header["jwk"]
+		if !ok {
+			return nil, fmt.Errorf("proof has no jwk header")
+		}
+		data, err := json.Marshal(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read jwk header: %w", err)
+		}
+		if key, err = jwk.ParseKey(data); err != nil {
+			return nil, fmt.Errorf("failed to parse jwk header: %w", err)
+		}
+		if private, _ := jwk.IsPrivateKey(key); private {
+			return nil, fmt.Errorf("jwk header must not contain a private key")
+		}
+
+		return jwk.PublicRawKeyOf(key)
+	}, jwt.WithValidMethods(SigningMethods))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProof, err)
+	}
+
+	if claims.ID == "" {
+		return nil, fmt.Errorf("%w: jti is required", ErrInvalidProof)
+	}
+	if !strings.EqualFold(claims.Method, method) {
+		return nil, fmt.Errorf("%w: htm does not match the request method", ErrInvalidProof)
+	}
+	if normalizeURL(claims.URL) != normalizeURL(requestURL) {
+		return nil, fmt.Errorf("%w: htu does not match the request URL", ErrInvalidProof)
+	}
+
+	if claims.IssuedAt == nil {
+		return nil, fmt.Errorf("%w: iat is required", ErrInvalidProof)
+	}
+	now := time.Now()
+	issuedAt := claims.IssuedAt.Time
+	// allow for a little clock skew between the client and the server
+	if issuedAt.After(now.Add(time.Minute)) || now.Sub(issuedAt) > v.maxAge {
+		return nil, fmt.Errorf("%w: proof is too old or issued in the future", ErrInvalidProof)
+	}
+
+	if accessToken != "" {
+		if claims.AccessTokenHash != AccessTokenHash(accessToken) {
+			return nil, fmt.Errorf("%w: ath does not match the access token", ErrInvalidProof)
+		}
+	}
+
+	thumbprint, err := Thumbprint(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProof, err)
+	}
+
+	if !v.markSeen(thumbprint+":"+claims.ID, now) {
+		return nil, fmt.Errorf("%w: proof has already been used", ErrInvalidProof)
+	}
+
+	return &Proof{
+		ID:              claims.ID,
+		Method:          claims.Method,
+		URL:             claims.URL,
+		IssuedAt:        issuedAt,
+		AccessTokenHash: claims.AccessTokenHash,
+		Key:             key,
+		Thumbprint:      thumbprint,
+	}, nil
+}
+
+// markSeen records a proof and returns false if it was seen before
+func (v *Verifier) markSeen(id string, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for seenID, seenAt := range v.seen {
+		if now.Sub(seenAt) > v.maxAge+time.Minute {
+			delete(v.seen, seenID)
+		}
+	}
+
+	if _, ok := v.seen[id]; ok {
+		return false
+	}
+	v.seen[id] = now
+	return true
+}
+
+// CheckBinding checks that a proof was signed with the key a token is bound to. jkt is
+// the cnf.jkt claim of the token
+func CheckBinding(jkt string, proof *Proof) error {
+	if jkt == "" {
+		return fmt.Errorf("token is not bound to a key")
+	}
+	if proof == nil || proof.Thumbprint != jkt {
+		return fmt.Errorf("%w: proof key does not match the token", ErrInvalidProof)
+	}
+	return nil
+}
+
+// Thumbprint returns the base64url encoded SHA-256 JWK thumbprint (RFC 7638) of a key
+func Thumbprint(key jwk.Key) (string, error) {
+	sum, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute key thumbprint: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(sum), nil
+}
+
+// AccessTokenHash returns the ath value of an access token
+func AccessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// RequestURL returns the URL of a request as a client addressed it, without query and fragment
+func RequestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.Path)
+}
+
+// normalizeURL drops the query and fragment and lower-cases scheme and host (RFC 9449 section 4.3)
+func normalizeURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/altacoda/tailbone/proto"
+)
+
+const (
+	// adminClientJoinTimeout is how long the CLI waits to join the tailnet
+	adminClientJoinTimeout = 60 * time.Second
+	// adminClientJoinRetry is how often the CLI checks whether it joined the tailnet
+	adminClientJoinRetry = time.Second
+)
+
+// adminTsServer is the Tailscale node the CLI joined the tailnet with, if any
+var adminTsServer *TsServer
+
+func init() {
+	// leave the tailnet once the command is done
+	cobra.OnFinalize(func() {
+		if adminTsServer != nil {
+			adminTsServer.Stop()
+		}
+	})
+}
+
+// AddAdminClientFlags adds the flags used to reach the admin server to a command group
+func AddAdminClientFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String("host", "", "Address of the admin server")
+	cmd.PersistentFlags().Int("port", 50051, "Port of the admin server")
+	cmd.PersistentFlags().Bool("tls", false, "Connect to the admin server over TLS, --host must be its MagicDNS name")
+	cmd.PersistentFlags().String("ts-authkey", "", "Tailscale auth key to join the tailnet with, instead of going through the local Tailscale client")
+	cmd.PersistentFlags().String("ts-dir", "", "Tailscale state directory when joining the tailnet (default is tailbone/tsnet in the user cache directory)")
+	cmd.PersistentFlags().String("ts-hostname", "tailbone-cli", "Tailscale hostname when joining the tailnet")
+
+	// flags are bound when the command runs so command groups don't override each other's bindings
+	cmd.PersistentPreRun = func(cmd *cobra.Command, _ []string) {
+		viper.BindPFlag("admin.client.host", cmd.Flags().Lookup("host"))
+		viper.BindPFlag("admin.client.port", cmd.Flags().Lookup("port"))
+		viper.BindPFlag("admin.client.tls", cmd.Flags().Lookup("tls"))
+		viper.BindPFlag("admin.client.tailscale.authkey", cmd.Flags().Lookup("ts-authkey"))
+		viper.BindPFlag("admin.client.tailscale.dir", cmd.Flags().Lookup("ts-dir"))
+		viper.BindPFlag("admin.client.tailscale.hostname", cmd.Flags().Lookup("ts-hostname"))
+	}
+}
+
+// NewAdminClient creates a new gRPC client connection to the admin server. With a Tailscale auth
+// key, the CLI joins the tailnet as an ephemeral node and connects through it
+func NewAdminClient(_ context.Context) (proto.AdminServiceClient, error) {
+	addr := fmt.Sprintf("%s:%d", viper.GetString("admin.client.host"), viper.GetInt("admin.client.port"))
+	creds := insecure.NewCredentials()
+	if viper.GetBool("admin.client.tls") {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+
+	if viper.GetString("admin.client.tailscale.authkey") != "" {
+		tsServer, err := joinTailnet()
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return tsServer.Server().Dial(ctx, "tcp", addr)
+		}))
+	}
+
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to admin server on %s: %w", addr, err)
+	}
+
+	return proto.NewAdminServiceClient(conn), nil
+}
+
+// HostIssuerURL returns the URL of the issuer on the admin server host, over HTTPS if the admin
+// server is reached over TLS
+func HostIssuerURL() (string, error) {
+	host := viper.GetString("admin.client.host")
+	if host == "" {
+		return "", fmt.Errorf("admin server host is not set")
+	}
+
+	scheme := "http"
+	if viper.GetBool("admin.client.tls") {
+		scheme = "https"
+	}
+	return scheme + "://" + host, nil
+}
+
+// joinTailnet starts the Tailscale node of the CLI and waits until it has an address
+func joinTailnet() (*TsServer, error) {
+	if adminTsServer != nil {
+		return adminTsServer, nil
+	}
+
+	dir := viper.GetString("admin.client.tailscale.dir")
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find user cache directory: %w", err)
+		}
+		dir = filepath.Join(cacheDir, "tailbone", "tsnet")
+	}
+
+	tsServer := NewTsServerWithConfig(TsConfig{
+		Hostname:    viper.GetString("admin.client.tailscale.hostname"),
+		AuthKey:     viper.GetString("admin.client.tailscale.authkey"),
+		Dir:         dir,
+		JoinTimeout: adminClientJoinTimeout,
+		JoinRetry:   adminClientJoinRetry,
+	})
+	adminTsServer = tsServer
+
+	if err := tsServer.Start(); err != nil {
+		return nil, fmt.Errorf("failed to join tailnet: %w", err)
+	}
+
+	if _, err := tsServer.LocalIp(); err != nil {
+		return nil, fmt.Errorf("failed to join tailnet: %w", err)
+	}
+
+	return tsServer, nil
+}
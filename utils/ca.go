@@ -0,0 +1,413 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyType is what a key is used for
+type KeyType string
+
+const (
+	KeyTypeJWT    KeyType = "jwt"     // signs JWTs, published in the JWKS
+	KeyTypeX509CA KeyType = "x509-ca" // signs X.509 client certificates
+	KeyTypeSSHCA  KeyType = "ssh-ca"  // signs OpenSSH user certificates
+)
+
+// KeyTypes lists the supported key types
+var KeyTypes = []KeyType{KeyTypeJWT, KeyTypeX509CA, KeyTypeSSHCA}
+
+// ParseKeyType parses a key type name. An empty name is a JWT signing key
+func ParseKeyType(name string) (KeyType, error) {
+	if name == "" {
+		return KeyTypeJWT, nil
+	}
+
+	for _, keyType := range KeyTypes {
+		if string(keyType) == name {
+			return keyType, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown key type %q", name)
+}
+
+// ErrNoCAKey is returned when a certificate authority has no usable key
+var ErrNoCAKey = errors.New("no CA key found")
+
+// CAStorage keeps the keys of a certificate authority in their own subdirectory of the key
+// directory, so they are never picked up as JWT signing keys
+type CAStorage struct {
+	keyType KeyType
+	dir     string
+	logger  zerolog.Logger
+}
+
+// NewCAStorage creates the storage of the certificate authority of the given key type
+func NewCAStorage(keyType KeyType) *CAStorage {
+	return &CAStorage{
+		keyType: keyType,
+		dir:     filepath.Join(viper.GetString("keys.dir"), string(keyType)),
+		logger:  GetLogger("ca_storage").With().Str("type", string(keyType)).Logger(),
+	}
+}
+
+// GenerateKey creates a new ECDSA P-256 CA key and saves it
+func (c *CAStorage) GenerateKey(_ context.Context) (jwk.Key, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ECDSA key: %w", err)
+	}
+
+	key, err := jwk.FromRaw(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JWK: %w", err)
+	}
+
+	kid := GetKeyId(time.Now())
+	if err := key.Set(jwk.KeyIDKey, kid); err != nil {
+		return nil, fmt.Errorf("failed to set key ID: %w", err)
+	}
+	if err := key.Set(jwk.AlgorithmKey, "ES256"); err != nil {
+		return nil, fmt.Errorf("failed to set algorithm: %w", err)
+	}
+
+	data, err := json.MarshalIndent(key, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+
+	if err := c.WriteFile(kid, ".private.jwk", data, 0600); err != nil {
+		return nil, err
+	}
+
+	c.logger.Info().Str("kid", kid).Msg("generated new CA key")
+	return key, nil
+}
+
+// Keys returns the private keys of the certificate authority, oldest first
+func (c *CAStorage) Keys(_ context.Context) ([]jwk.Key, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read CA key directory: %w", err)
+	}
+
+	var keys []jwk.Key
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".private.jwk") {
+			continue
+		}
+
+		path := filepath.Join(c.dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			c.logger.Error().Err(err).Str("file", path).Msg("failed to read CA key file")
+			continue
+		}
+
+		key, err := jwk.ParseKey(data)
+		if err != nil {
+			c.logger.Error().Err(err).Str("file", path).Msg("failed to parse CA key")
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].KeyID() < keys[j].KeyID()
+	})
+
+	return keys, nil
+}
+
+// WriteFile writes a file belonging to the key kid, e.g. its certificate
+func (c *CAStorage) WriteFile(kid, suffix string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create CA key directory: %w", err)
+	}
+
+	path := filepath.Join(c.dir, kid+suffix)
+	if err := WriteFileAtomic(path, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// ReadFile reads a file belonging to the key kid
+func (c *CAStorage) ReadFile(kid, suffix string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(c.dir, kid+suffix))
+}
+
+// DeleteKey removes the key kid and every file belonging to it. kid must be the ID of one of
+// the stored keys, it is never used to build a path
+func (c *CAStorage) DeleteKey(ctx context.Context, kid string) error {
+	keys, err := c.Keys(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !slices.ContainsFunc(keys, func(key jwk.Key) bool { return key.KeyID() == kid }) {
+		return fmt.Errorf("key %s not found", kid)
+	}
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list CA key files: %w", err)
+	}
+
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), kid+".") {
+			continue
+		}
+
+		path := filepath.Join(c.dir, entry.Name())
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			c.logger.Error().Err(err).Str("file", path).Msg("failed to delete CA key file")
+			return fmt.Errorf("failed to delete CA key file: %w", err)
+		}
+	}
+
+	c.logger.Info().Str("kid", kid).Msg("deleted CA key")
+	return nil
+}
+
+// X509CA is a key of the X.509 certificate authority with its self-signed certificate
+type X509CA struct {
+	KeyID       string
+	Signer      crypto.Signer
+	Certificate *x509.Certificate
+}
+
+// NewX509CACertificate creates the self-signed certificate of a new X.509 CA key
+func NewX509CACertificate(ctx context.Context, storage *CAStorage, key jwk.Key, validity time.Duration) (*x509.Certificate, error) {
+	var signer crypto.Signer
+	if err := key.Raw(&signer); err != nil {
+		return nil, fmt.Errorf("failed to get raw CA key: %w", err)
+	}
+
+	serial, err := NewCertificateSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   fmt.Sprintf("%s CA %s", viper.GetString("keys.issuer"), key.KeyID()),
+			Organization: []string{"Tailbone"},
+		},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+
+	if err := storage.WriteFile(key.KeyID(), ".crt", EncodeCertificatesPEM(der), 0644); err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// LoadX509CAs returns the keys of the X.509 certificate authority with their certificates, oldest first
+func LoadX509CAs(ctx context.Context, storage *CAStorage) ([]*X509CA, error) {
+	keys, err := storage.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var cas []*X509CA
+	for _, key := range keys {
+		var signer crypto.Signer
+		if err := key.Raw(&signer); err != nil {
+			storage.logger.Error().Err(err).Str("kid", key.KeyID()).Msg("failed to get raw CA key")
+			continue
+		}
+
+		data, err := storage.ReadFile(key.KeyID(), ".crt")
+		if err != nil {
+			storage.logger.Error().Err(err).Str("kid", key.KeyID()).Msg("failed to read CA certificate")
+			continue
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "CERTIFICATE" {
+			storage.logger.Error().Str("kid", key.KeyID()).Msg("CA certificate is not a PEM certificate")
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			storage.logger.Error().Err(err).Str("kid", key.KeyID()).Msg("failed to parse CA certificate")
+			continue
+		}
+
+		cas = append(cas, &X509CA{
+			KeyID:       key.KeyID(),
+			Signer:      signer,
+			Certificate: cert,
+		})
+	}
+
+	return cas, nil
+}
+
+// LatestX509CA returns the newest X.509 CA key whose certificate has not expired
+func LatestX509CA(ctx context.Context, storage *CAStorage) (*X509CA, error) {
+	cas, err := LoadX509CAs(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i := len(cas) - 1; i >= 0; i-- {
+		if now.Before(cas[i].Certificate.NotAfter) {
+			return cas[i], nil
+		}
+	}
+
+	return nil, ErrNoCAKey
+}
+
+// X509CABundle returns the PEM encoded certificates of all X.509 CA keys
+func X509CABundle(ctx context.Context, storage *CAStorage) ([]byte, error) {
+	cas, err := LoadX509CAs(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := make([][]byte, 0, len(cas))
+	for _, ca := range cas {
+		certs = append(certs, ca.Certificate.Raw)
+	}
+
+	return EncodeCertificatesPEM(certs...), nil
+}
+
+// EncodeCertificatesPEM PEM encodes DER certificates
+func EncodeCertificatesPEM(certs ...[]byte) []byte {
+	var out []byte
+	for _, der := range certs {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return out
+}
+
+// NewCertificateSerial returns a random 128 bit certificate serial number
+func NewCertificateSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
+
+// SSHCA is a key of the SSH certificate authority
+type SSHCA struct {
+	KeyID  string
+	Signer ssh.Signer
+}
+
+// LoadSSHCAs returns the keys of the SSH certificate authority, oldest first
+func LoadSSHCAs(ctx context.Context, storage *CAStorage) ([]*SSHCA, error) {
+	keys, err := storage.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var cas []*SSHCA
+	for _, key := range keys {
+		var raw crypto.Signer
+		if err := key.Raw(&raw); err != nil {
+			storage.logger.Error().Err(err).Str("kid", key.KeyID()).Msg("failed to get raw CA key")
+			continue
+		}
+
+		signer, err := ssh.NewSignerFromSigner(raw)
+		if err != nil {
+			storage.logger.Error().Err(err).Str("kid", key.KeyID()).Msg("failed to create SSH signer")
+			continue
+		}
+
+		cas = append(cas, &SSHCA{
+			KeyID:  key.KeyID(),
+			Signer: signer,
+		})
+	}
+
+	return cas, nil
+}
+
+// LatestSSHCA returns the newest SSH CA key
+func LatestSSHCA(ctx context.Context, storage *CAStorage) (*SSHCA, error) {
+	cas, err := LoadSSHCAs(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cas) == 0 {
+		return nil, ErrNoCAKey
+	}
+
+	return cas[len(cas)-1], nil
+}
+
+// SSHCAPublicKeys returns the public keys of all SSH CA keys in authorized_keys format, one
+// per line with the key ID as comment, as expected by sshd's TrustedUserCAKeys
+func SSHCAPublicKeys(ctx context.Context, storage *CAStorage) ([]byte, error) {
+	cas, err := LoadSSHCAs(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	for _, ca := range cas {
+		out = append(out, MarshalSSHPublicKey(ca.Signer.PublicKey(), ca.KeyID)...)
+	}
+	return out, nil
+}
+
+// MarshalSSHPublicKey encodes a public key or certificate as an authorized_keys line
+func MarshalSSHPublicKey(key ssh.PublicKey, comment string) []byte {
+	line := bytes.TrimSuffix(ssh.MarshalAuthorizedKey(key), []byte("\n"))
+	if comment != "" {
+		line = append(line, ' ')
+		line = append(line, comment...)
+	}
+	return append(line, '\n')
+}
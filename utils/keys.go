@@ -23,6 +23,31 @@ type JWKS struct {
 	Keys []jwk.Key `json:"keys"`
 }
 
+// KeyStatus is the outcome of verifying a key
+type KeyStatus string
+
+const (
+	KeyStatusOK             KeyStatus = "ok"
+	KeyStatusCorrupt        KeyStatus = "corrupt"         // key file cannot be parsed or the key is invalid
+	KeyStatusMismatch       KeyStatus = "mismatch"        // local public key is not derived from the private key
+	KeyStatusRemoteMismatch KeyStatus = "remote_mismatch" // published public key is not derived from the private key
+	KeyStatusMissingPrivate KeyStatus = "missing_private" // public key has no matching private key
+	KeyStatusMissingPublic  KeyStatus = "missing_public"  // private key has no matching local public key
+	KeyStatusNotPublished   KeyStatus = "not_published"   // private key is not in the published JWKS
+)
+
+// KeyCheck holds the verification result of a single key
+type KeyCheck struct {
+	KeyID  string    `json:"key_id"`
+	Status KeyStatus `json:"status"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// OK returns true if the key passed verification
+func (c KeyCheck) OK() bool {
+	return c.Status == KeyStatusOK
+}
+
 func ParseCreatedAt(keyID string) (time.Time, error) {
 	if parts := strings.Split(keyID, "-"); len(parts) > 1 {
 		if ts, err := strconv.ParseInt(parts[1], 10, 64); err != nil {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/lestrrat-go/jwx/v2/jwk"
@@ -17,6 +18,7 @@ type ILocalKeyStorage interface {
 	GetLocalJWKs(ctx context.Context) (*JWKS, error)
 	SaveLocalJWKs(ctx context.Context, jwks *JWKS) error
 	DeleteLocalJWK(ctx context.Context, kid string) error
+	VerifyLocalJWKs(ctx context.Context, remote *JWKS) ([]KeyCheck, error)
 }
 
 // LocalKeyStorage handles storage and retrieval of JWKs from local filesystem
@@ -136,4 +138,144 @@ func (l *LocalKeyStorage) DeleteLocalJWK(ctx context.Context, kid string) error
 	return nil
 }
 
+// VerifyLocalJWKs checks that every local public key and, when given, every key in the
+// remote JWKS is derived from the matching local private key
+func (l *LocalKeyStorage) VerifyLocalJWKs(ctx context.Context, remote *JWKS) ([]KeyCheck, error) {
+	files, err := os.ReadDir(l.keyDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key directory: %w", err)
+	}
+
+	privateKeys := make(map[string]jwk.Key)
+	publicKeys := make(map[string]jwk.Key)
+	checks := make(map[string]KeyCheck)
+
+	for _, file := range files {
+		var kid string
+		var keys map[string]jwk.Key
+		switch {
+		case strings.HasSuffix(file.Name(), ".private.jwk"):
+			kid = strings.TrimSuffix(file.Name(), ".private.jwk")
+			keys = privateKeys
+		case strings.HasSuffix(file.Name(), ".public.jwk"):
+			kid = strings.TrimSuffix(file.Name(), ".public.jwk")
+			keys = publicKeys
+		default:
+			continue
+		}
+
+		key, err := l.readKeyFile(filepath.Join(l.keyDir, file.Name()))
+		if err != nil {
+			checks[kid] = KeyCheck{KeyID: kid, Status: KeyStatusCorrupt, Detail: fmt.Sprintf("%s: %s", file.Name(), err)}
+			continue
+		}
+
+		if key.KeyID() != kid {
+			checks[kid] = KeyCheck{KeyID: kid, Status: KeyStatusCorrupt, Detail: fmt.Sprintf("%s: key ID %q does not match file name", file.Name(), key.KeyID())}
+			continue
+		}
+
+		keys[kid] = key
+	}
+
+	for kid, privateKey := range privateKeys {
+		if _, failed := checks[kid]; failed {
+			continue
+		}
+		checks[kid] = verifyKeyPair(kid, privateKey, publicKeys[kid], remote)
+	}
+
+	for kid := range publicKeys {
+		if _, checked := checks[kid]; !checked {
+			checks[kid] = KeyCheck{KeyID: kid, Status: KeyStatusMissingPrivate, Detail: "local public key has no private key"}
+		}
+	}
+
+	if remote != nil {
+		for _, key := range remote.Keys {
+			if _, checked := checks[key.KeyID()]; !checked {
+				checks[key.KeyID()] = KeyCheck{KeyID: key.KeyID(), Status: KeyStatusMissingPrivate, Detail: "published key has no local private key"}
+			}
+		}
+	}
+
+	result := make([]KeyCheck, 0, len(checks))
+	for _, check := range checks {
+		result = append(result, check)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].KeyID < result[j].KeyID
+	})
+
+	l.logger.Info().Int("total_keys", len(result)).Msg("verified local JWKs")
+	return result, nil
+}
+
+func (l *LocalKeyStorage) readKeyFile(path string) (jwk.Key, error) {
+	keyData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	key, err := jwk.ParseKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key: %w", err)
+	}
+
+	return key, nil
+}
+
+// verifyKeyPair checks a private key against its local and published public keys
+func verifyKeyPair(kid string, privateKey, publicKey jwk.Key, remote *JWKS) KeyCheck {
+	isPrivate, err := jwk.IsPrivateKey(privateKey)
+	if err != nil || !isPrivate {
+		return KeyCheck{KeyID: kid, Status: KeyStatusCorrupt, Detail: "private key file does not contain a private key"}
+	}
+
+	var raw interface{}
+	if err := privateKey.Raw(&raw); err != nil {
+		return KeyCheck{KeyID: kid, Status: KeyStatusCorrupt, Detail: fmt.Sprintf("failed to get raw private key: %s", err)}
+	}
+
+	if validator, ok := raw.(interface{ Validate() error }); ok {
+		if err := validator.Validate(); err != nil {
+			return KeyCheck{KeyID: kid, Status: KeyStatusCorrupt, Detail: fmt.Sprintf("invalid private key: %s", err)}
+		}
+	}
+
+	derived, err := jwk.PublicKeyOf(privateKey)
+	if err != nil {
+		return KeyCheck{KeyID: kid, Status: KeyStatusCorrupt, Detail: fmt.Sprintf("failed to derive public key: %s", err)}
+	}
+
+	if publicKey != nil && !jwk.Equal(derived, publicKey) {
+		return KeyCheck{KeyID: kid, Status: KeyStatusMismatch, Detail: "local public key does not match the private key"}
+	}
+
+	if remote != nil {
+		var published jwk.Key
+		for _, key := range remote.Keys {
+			if key.KeyID() == kid {
+				published = key
+				break
+			}
+		}
+
+		if published == nil {
+			return KeyCheck{KeyID: kid, Status: KeyStatusNotPublished, Detail: "private key is not in the published JWKS"}
+		}
+
+		if !jwk.Equal(derived, published) {
+			return KeyCheck{KeyID: kid, Status: KeyStatusRemoteMismatch, Detail: "published public key does not match the private key"}
+		}
+	}
+
+	if publicKey == nil {
+		return KeyCheck{KeyID: kid, Status: KeyStatusMissingPublic, Detail: "private key has no local public key"}
+	}
+
+	return KeyCheck{KeyID: kid, Status: KeyStatusOK}
+}
+
 var _ ILocalKeyStorage = &LocalKeyStorage{}
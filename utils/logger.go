@@ -30,14 +30,17 @@ func InitLogger() {
 	}
 	zerolog.SetGlobalLevel(level)
 
+	// Tokens are masked before anything reaches stdout
+	out := NewRedactingWriter(os.Stdout)
+
 	logFormat := viper.GetString("log.format")
 	if logFormat == "json" {
 		// Create file writer
-		Logger = zerolog.New(os.Stdout)
+		Logger = zerolog.New(out)
 	} else {
 		// Create console writer
 		Logger = zerolog.New(zerolog.ConsoleWriter{
-			Out:     os.Stdout,
+			Out:     out,
 			NoColor: viper.GetBool("log.no_color"),
 		}).
 			With().
@@ -48,7 +51,8 @@ func InitLogger() {
 
 }
 
-// GetLogger returns a child logger with additional context
+// GetLogger returns a child logger with additional context. Child loggers share the
+// redacting writer of the global logger so token-like values are never written as-is
 func GetLogger(component string) zerolog.Logger {
 	return Logger.With().Str("component", component).Logger()
 }
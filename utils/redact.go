@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"regexp"
+	"sync"
+)
+
+// maxPendingSize limits how much of an unterminated line is held back before it is written
+const maxPendingSize = 64 << 10
+
+var (
+	// jwtPattern matches compact JWS/JWT values (header.payload.signature)
+	jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	// bearerPattern matches credentials following a bearer authorization scheme. Short
+	// values are ignored so words following "bearer" in log messages are left alone
+	bearerPattern = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/-]{20,}=*`)
+	// secretFieldPattern matches opaque secrets such as refresh tokens by the name of the field
+	// or form parameter they are logged in
+	secretFieldPattern = regexp.MustCompile(`(?i)((?:refresh_token|client_secret|subject_token)["']?\s*[:=]\s*["']?)[A-Za-z0-9._~+/-]{20,}=*`)
+)
+
+// RedactingWriter masks token-like values before they reach the underlying writer. Output is
+// written line by line, so a token split across several writes is still redacted
+type RedactingWriter struct {
+	w       io.Writer
+	mu      sync.Mutex
+	pending []byte
+}
+
+// NewRedactingWriter wraps w so that tokens written to it are redacted
+func NewRedactingWriter(w io.Writer) *RedactingWriter {
+	return &RedactingWriter{w: w}
+}
+
+func (r *RedactingWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending = append(r.pending, p...)
+
+	// hold back the end of an unterminated line unless it grows too large
+	end := bytes.LastIndexByte(r.pending, '\n') + 1
+	if len(r.pending) >= maxPendingSize {
+		end = len(r.pending)
+	}
+	if end == 0 {
+		return len(p), nil
+	}
+
+	if err := r.flush(end); err != nil {
+		return 0, err
+	}
+
+	// report the original length, callers don't expect the output to change size
+	return len(p), nil
+}
+
+// Flush writes a pending unterminated line
+func (r *RedactingWriter) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.flush(len(r.pending))
+}
+
+// flush redacts and writes the first n pending bytes. The caller must hold mu
+func (r *RedactingWriter) flush(n int) error {
+	_, err := r.w.Write(RedactTokens(r.pending[:n]))
+	r.pending = append(r.pending[:0], r.pending[n:]...)
+	return err
+}
+
+// RedactTokens replaces JWTs, bearer credentials and secrets such as refresh tokens in p
+// with their fingerprint
+func RedactTokens(p []byte) []byte {
+	p = jwtPattern.ReplaceAllFunc(p, redactValue)
+	p = redactAfterPrefix(bearerPattern, p)
+	return redactAfterPrefix(secretFieldPattern, p)
+}
+
+// redactAfterPrefix redacts the matches of pattern, keeping its first group
+func redactAfterPrefix(pattern *regexp.Regexp, p []byte) []byte {
+	return pattern.ReplaceAllFunc(p, func(match []byte) []byte {
+		prefix := pattern.FindSubmatch(match)[1]
+		return append(append([]byte{}, prefix...), redactValue(match[len(prefix):])...)
+	})
+}
+
+// TokenFingerprint returns a short, non-reversible identifier of a token that is safe to log
+func TokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+func redactValue(value []byte) []byte {
+	return []byte("[REDACTED:" + TokenFingerprint(string(value)) + "]")
+}
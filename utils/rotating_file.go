@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RotatingFile is an append-only file that is rotated once it grows beyond a maximum size.
+// Rotated files are renamed to <path>.1, <path>.2 and so on, keeping at most maxBackups of them
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+}
+
+// NewRotatingFile opens (or creates) the file at path for appending
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	f := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Path returns the path of the current file
+func (f *RotatingFile) Path() string {
+	return f.path
+}
+
+// BackupPath returns the path of the nth rotated file
+func (f *RotatingFile) BackupPath(n int) string {
+	return fmt.Sprintf("%s.%d", f.path, n)
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, fmt.Errorf("file is closed")
+	}
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", f.path, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat %s: %w", f.path, err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", f.path, err)
+	}
+	f.file = nil
+
+	if f.maxBackups > 0 {
+		if err := os.Remove(f.BackupPath(f.maxBackups)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove oldest backup: %w", err)
+		}
+
+		for n := f.maxBackups - 1; n > 0; n-- {
+			if err := os.Rename(f.BackupPath(n), f.BackupPath(n+1)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to rotate backup: %w", err)
+			}
+		}
+
+		if err := os.Rename(f.path, f.BackupPath(1)); err != nil {
+			return fmt.Errorf("failed to rotate %s: %w", f.path, err)
+		}
+	} else if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to truncate %s: %w", f.path, err)
+	}
+
+	return f.open()
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+
+	"github.com/altacoda/tailbone/client"
+)
+
+// AddTokenClientFlags adds the flags used to get tokens from the issuer to a command
+func AddTokenClientFlags(cmd *cobra.Command) {
+	cmd.Flags().String("issuer-url", "", "URL of the Tailbone issuer (default is http://<host>, or https://<host> with --tls)")
+	cmd.Flags().String("cache-dir", "", "Directory tokens are cached in (default is tailbone/tokens in the user cache directory)")
+
+	cmd.PreRun = func(cmd *cobra.Command, _ []string) {
+		viper.BindPFlag("token.issuerUrl", cmd.Flags().Lookup("issuer-url"))
+		viper.BindPFlag("token.cacheDir", cmd.Flags().Lookup("cache-dir"))
+	}
+}
+
+// IssuerURL returns the URL tokens are requested from, derived from the admin server host if not set
+func IssuerURL() (string, error) {
+	if issuerURL := viper.GetString("token.issuerUrl"); issuerURL != "" {
+		return issuerURL, nil
+	}
+
+	issuerURL, err := HostIssuerURL()
+	if err != nil {
+		return "", fmt.Errorf("issuer URL is not set, use --issuer-url or --host")
+	}
+	return issuerURL, nil
+}
+
+// GetToken requests a token for the audience from the issuer. With useCache, tokens are kept on
+// disk and reused by later calls while they are valid for at least client.DefaultRefreshBefore
+func GetToken(ctx context.Context, audience []string, useCache bool) (*oauth2.Token, error) {
+	issuerURL, err := IssuerURL()
+	if err != nil {
+		return nil, err
+	}
+
+	cachePath := ""
+	if useCache {
+		cachePath, err = tokenCachePath(issuerURL, audience)
+		if err != nil {
+			return nil, err
+		}
+
+		var cached oauth2.Token
+		if err := ReadJSONFile(cachePath, &cached); err == nil && cached.AccessToken != "" &&
+			time.Until(cached.Expiry) > client.DefaultRefreshBefore {
+			return &cached, nil
+		}
+	}
+
+	source, err := client.NewTokenSource(client.Config{
+		IssuerURL: issuerURL,
+		Audience:  audience,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	token, err := source.TokenContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if cachePath != "" {
+		if err := WriteJSONFile(cachePath, token, 0600); err != nil {
+			return nil, fmt.Errorf("failed to cache token: %w", err)
+		}
+	}
+
+	return token, nil
+}
+
+// ForgetToken removes the cached token for the audience, so the next GetToken requests a new one
+func ForgetToken(audience []string) error {
+	issuerURL, err := IssuerURL()
+	if err != nil {
+		return err
+	}
+
+	cachePath, err := tokenCachePath(issuerURL, audience)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(cachePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove cached token: %w", err)
+	}
+	return nil
+}
+
+// tokenCachePath returns the file the token of an issuer for an audience is cached in
+func tokenCachePath(issuerURL string, audience []string) (string, error) {
+	dir := viper.GetString("token.cacheDir")
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to find user cache directory: %w", err)
+		}
+		dir = filepath.Join(cacheDir, "tailbone", "tokens")
+	}
+
+	audience = slices.Clone(audience)
+	slices.Sort(audience)
+
+	sum := sha256.Sum256([]byte(strings.TrimSuffix(issuerURL, "/") + "\n" + strings.Join(audience, "\n")))
+	return filepath.Join(dir, hex.EncodeToString(sum[:16])+".json"), nil
+}
@@ -11,36 +11,72 @@ import (
 	"tailscale.com/tsnet"
 )
 
+// TsConfig configures the embedded Tailscale node
+type TsConfig struct {
+	Hostname    string
+	AuthKey     string
+	Dir         string
+	JoinTimeout time.Duration
+	JoinRetry   time.Duration
+}
+
 type TsServer struct {
 	logger zerolog.Logger
 	server *tsnet.Server
+	config *TsConfig
 }
 
+// NewTsServer creates the Tailscale node of the server, configured with the server.tailscale settings
 func NewTsServer() *TsServer {
 	return &TsServer{
 		logger: GetLogger("ts"),
 	}
 }
 
+// NewTsServerWithConfig creates a Tailscale node with its own configuration
+func NewTsServerWithConfig(config TsConfig) *TsServer {
+	return &TsServer{
+		logger: GetLogger("ts"),
+		config: &config,
+	}
+}
+
+// getConfig returns the configuration of the node, read from the server.tailscale settings if
+// none was given
+func (t *TsServer) getConfig() TsConfig {
+	if t.config != nil {
+		return *t.config
+	}
+
+	return TsConfig{
+		Hostname:    viper.GetString("server.tailscale.hostname"),
+		AuthKey:     viper.GetString("server.tailscale.authkey"),
+		Dir:         viper.GetString("server.tailscale.dir"),
+		JoinTimeout: viper.GetDuration("server.tailscale.joinTimeout"),
+		JoinRetry:   viper.GetDuration("server.tailscale.joinRetry"),
+	}
+}
+
 func (t *TsServer) Start() error {
 	logger := t.logger
 	logger.Info().Msg("initializing tailscale server")
+	config := t.getConfig()
 
-	if viper.GetString("server.tailscale.authkey") == "" {
+	if config.AuthKey == "" {
 		return fmt.Errorf("tailscale auth key is not set")
 	}
 
-	if viper.GetString("server.tailscale.dir") == "" {
+	if config.Dir == "" {
 		return fmt.Errorf("tailscale state directory is not set")
 	}
 
-	if viper.GetString("server.tailscale.hostname") == "" {
+	if config.Hostname == "" {
 		return fmt.Errorf("tailscale hostname is not set")
 	}
 
 	// if tsdir does not exist, create it
-	if _, err := os.Stat(viper.GetString("server.tailscale.dir")); os.IsNotExist(err) {
-		err = os.MkdirAll(viper.GetString("server.tailscale.dir"), 0755)
+	if _, err := os.Stat(config.Dir); os.IsNotExist(err) {
+		err = os.MkdirAll(config.Dir, 0755)
 		if err != nil {
 			return fmt.Errorf("failed to create tailscale dir: %w", err)
 		}
@@ -49,11 +85,11 @@ func (t *TsServer) Start() error {
 	tsLogger := GetLogger("tsnet")
 
 	t.server = &tsnet.Server{
-		Hostname:  viper.GetString("server.tailscale.hostname"),
-		AuthKey:   viper.GetString("server.tailscale.authkey"),
+		Hostname:  config.Hostname,
+		AuthKey:   config.AuthKey,
 		Logf:      func(msg string, v ...interface{}) { tsLogger.Trace().Msgf(msg, v...) },
 		UserLogf:  func(msg string, v ...interface{}) { tsLogger.Debug().Msgf(msg, v...) },
-		Dir:       viper.GetString("server.tailscale.dir"),
+		Dir:       config.Dir,
 		Ephemeral: true,
 	}
 
@@ -81,8 +117,9 @@ func (t *TsServer) LocalIp() (*netip.Addr, error) {
 		return nil, fmt.Errorf("server not initialized")
 	}
 
-	timeout := time.After(viper.GetDuration("server.tailscale.joinTimeout"))
-	tick := time.NewTicker(viper.GetDuration("server.tailscale.joinRetry"))
+	config := t.getConfig()
+	timeout := time.After(config.JoinTimeout)
+	tick := time.NewTicker(config.JoinRetry)
 	defer tick.Stop()
 
 	t.logger.Info().Msg("waiting for valid IP address")
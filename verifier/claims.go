@@ -0,0 +1,28 @@
+package verifier
+
+import "github.com/golang-jwt/jwt/v5"
+
+// TokenClaims represents the claims of a Tailbone token
+type TokenClaims struct {
+	jwt.RegisteredClaims
+	User         string        `json:"user"`
+	DisplayName  string        `json:"display_name"`
+	Tags         []string      `json:"tags,omitempty"`
+	Capabilities []string      `json:"caps,omitempty"`
+	Act          *ActorClaim   `json:"act,omitempty"`
+	Cnf          *Confirmation `json:"cnf,omitempty"`
+}
+
+// Confirmation binds a token to a key of its holder (RFC 7800)
+type Confirmation struct {
+	// JKT is the JWK thumbprint of the holder's DPoP key (RFC 9449 section 6.1)
+	JKT string `json:"jkt"`
+}
+
+// ActorClaim identifies the party acting on behalf of the subject of a token (RFC 8693 section 4.1).
+// Nested actors record the chain of prior delegations
+type ActorClaim struct {
+	Subject string      `json:"sub"`
+	User    string      `json:"user,omitempty"`
+	Act     *ActorClaim `json:"act,omitempty"`
+}
@@ -0,0 +1,92 @@
+package verifier
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// MethodRequirements maps gRPC methods to the requirements of their calls. Keys are prefixes of
+// full method names: "/" applies to all methods, "/pkg.Service/" to the methods of a service and
+// "/pkg.Service/Method" to a single method. A call must satisfy the requirements of every
+// matching key
+type MethodRequirements map[string][]Requirement
+
+// forMethod returns the requirements of a method
+func (m MethodRequirements) forMethod(fullMethod string) []Requirement {
+	var requirements []Requirement
+	for prefix, reqs := range m {
+		if strings.HasPrefix(fullMethod, prefix) {
+			requirements = append(requirements, reqs...)
+		}
+	}
+	return requirements
+}
+
+// UnaryServerInterceptor returns a gRPC interceptor that verifies the token in the authorization
+// metadata of each call and stores its claims in the call context
+func (v *Verifier) UnaryServerInterceptor(requirements MethodRequirements) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := v.authorizeCall(ctx, info.FullMethod, requirements)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns a gRPC interceptor that verifies the token in the authorization
+// metadata of each stream and stores its claims in the stream context
+func (v *Verifier) StreamServerInterceptor(requirements MethodRequirements) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := v.authorizeCall(ss.Context(), info.FullMethod, requirements)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &verifiedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authorizeCall verifies the token of a call and checks the requirements of its method
+func (v *Verifier) authorizeCall(ctx context.Context, fullMethod string, requirements MethodRequirements) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) != 1 {
+		return nil, status.Error(codes.Unauthenticated, ErrMissingToken.Error())
+	}
+
+	scheme, tokenString, _ := strings.Cut(values[0], " ")
+	if scheme != "Bearer" || tokenString == "" {
+		return nil, status.Error(codes.Unauthenticated, ErrMissingToken.Error())
+	}
+
+	claims, err := v.Verify(ctx, tokenString)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	// gRPC has no standard way to present DPoP proofs
+	if claims.Cnf != nil {
+		return nil, status.Error(codes.Unauthenticated, "DPoP-bound tokens are not supported over gRPC")
+	}
+
+	if err := checkRequirements(claims, requirements.forMethod(fullMethod)); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	return NewContext(ctx, claims), nil
+}
+
+// verifiedStream carries the claims of a verified token in its context
+type verifiedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *verifiedStream) Context() context.Context {
+	return s.ctx
+}
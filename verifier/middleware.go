@@ -0,0 +1,80 @@
+package verifier
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/altacoda/tailbone/dpop"
+)
+
+// ErrMissingToken is returned when a request carries no token
+var ErrMissingToken = errors.New("missing bearer token")
+
+// Middleware returns net/http middleware that verifies the token of each request and stores its
+// claims in the request context. Requests without a valid token get 401 Unauthorized, those whose
+// token does not satisfy the requirements 403 Forbidden. Wrap routes separately to give them
+// different requirements:
+//
+//	mux.Handle("/billing/", v.Middleware(verifier.RequireAudience("billing-service"))(billing))
+func (v *Verifier) Middleware(requirements ...Requirement) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, err := v.VerifyRequest(r)
+			if errors.Is(err, ErrMissingToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="tailbone"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="tailbone", error="invalid_token"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			if err := checkRequirements(claims, requirements); err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="tailbone", error="insufficient_scope"`)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), claims)))
+		})
+	}
+}
+
+// VerifyRequest verifies the token in the Authorization header of a request. Tokens bound to a
+// DPoP key must be presented with the DPoP scheme and a proof for the request
+func (v *Verifier) VerifyRequest(r *http.Request) (*TokenClaims, error) {
+	scheme, tokenString, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if (scheme != "Bearer" && scheme != dpop.TokenType) || tokenString == "" {
+		return nil, ErrMissingToken
+	}
+
+	claims, err := v.Verify(r.Context(), tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Cnf == nil {
+		if scheme == dpop.TokenType {
+			return nil, fmt.Errorf("%w: token is not bound to a DPoP key", ErrInvalidToken)
+		}
+		return claims, nil
+	}
+
+	if scheme != dpop.TokenType {
+		return nil, fmt.Errorf("%w: DPoP-bound token presented as a bearer token", ErrInvalidToken)
+	}
+
+	proof, err := v.dpop.VerifyRequest(r, tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dpop.CheckBinding(claims.Cnf.JKT, proof); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
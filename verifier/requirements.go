@@ -0,0 +1,110 @@
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ErrRequirementNotMet is returned when a verified token does not satisfy the requirements of a route
+var ErrRequirementNotMet = errors.New("token does not satisfy the requirements")
+
+// Requirement is a check a verified token must pass to access a route
+type Requirement func(claims *TokenClaims) error
+
+// RequireAudience requires the token to be issued for one of the audiences
+func RequireAudience(audiences ...string) Requirement {
+	return func(claims *TokenClaims) error {
+		for _, audience := range audiences {
+			if slices.Contains(claims.Audience, audience) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: token is not issued for %v", ErrRequirementNotMet, audiences)
+	}
+}
+
+// RequireClaim requires a claim to have one of the values. A list claim, such as tags, satisfies
+// the requirement if one of its values does
+func RequireClaim(claim string, values ...string) Requirement {
+	return func(claims *TokenClaims) error {
+		data, err := json.Marshal(claims)
+		if err != nil {
+			return fmt.Errorf("failed to marshal claims: %w", err)
+		}
+		var all map[string]interface{}
+		if err := json.Unmarshal(data, &all); err != nil {
+			return fmt.Errorf("failed to unmarshal claims: %w", err)
+		}
+
+		if !claimMatches(all[claim], values) {
+			return fmt.Errorf("%w: claim %s is not one of %v", ErrRequirementNotMet, claim, values)
+		}
+		return nil
+	}
+}
+
+// RequireTag requires the token to be issued to a node with one of the tags
+func RequireTag(tags ...string) Requirement {
+	return RequireClaim("tags", tags...)
+}
+
+// checkRequirements returns the first requirement the claims do not satisfy
+func checkRequirements(claims *TokenClaims, requirements []Requirement) error {
+	for _, requirement := range requirements {
+		if err := requirement(claims); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimMatches returns true if a claim value, or one of the values of a list claim, is allowed
+func claimMatches(value interface{}, allowed []string) bool {
+	switch value := value.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		for _, item := range value {
+			if claimMatches(item, allowed) {
+				return true
+			}
+		}
+		return false
+	case string:
+		return slices.Contains(allowed, value)
+	default:
+		return slices.Contains(allowed, fmt.Sprint(value))
+	}
+}
+
+type claimsKey struct{}
+
+// NewContext returns a copy of ctx carrying the claims of a verified token
+func NewContext(ctx context.Context, claims *TokenClaims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// FromContext returns the claims of the verified token stored in ctx by the middleware or interceptors
+func FromContext(ctx context.Context) (*TokenClaims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*TokenClaims)
+	return claims, ok
+}
+
+// UserFromContext returns the Tailscale login name of the caller stored in ctx, or an empty string
+func UserFromContext(ctx context.Context) string {
+	if claims, ok := FromContext(ctx); ok {
+		return claims.User
+	}
+	return ""
+}
+
+// TagsFromContext returns the tags of the caller's node stored in ctx, if any
+func TagsFromContext(ctx context.Context) []string {
+	if claims, ok := FromContext(ctx); ok {
+		return claims.Tags
+	}
+	return nil
+}
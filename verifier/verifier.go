@@ -0,0 +1,313 @@
+// Package verifier verifies Tailbone tokens in Go services.
+//
+// A Verifier fetches the JWKS from the issuer or from the S3 bucket it is published to, keeps it
+// fresh in the background and refetches it when a token is signed with a key it does not know yet:
+//
+//	v, err := verifier.New(ctx, verifier.Config{
+//		JWKSURL:   "https://<bucket>.s3.amazonaws.com/.well-known/jwks.json",
+//		Audiences: []string{"billing-service"},
+//	})
+//	if err != nil { ... }
+//	defer v.Close()
+//
+//	claims, err := v.Verify(ctx, token)
+//	if errors.Is(err, verifier.ErrTokenExpired) { ... }
+//
+// Middleware and gRPC interceptors verify the tokens of incoming requests and store their claims
+// in the request context, where handlers get them with FromContext.
+//
+// Tokens bound to a DPoP key carry the key thumbprint in claims.Cnf. The middleware checks their
+// proofs, callers of Verify must check them with the dpop package.
+package verifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+
+	"github.com/altacoda/tailbone/dpop"
+)
+
+const (
+	// DefaultIssuer is the iss claim of tokens issued by a Tailbone server with default settings
+	DefaultIssuer = "tailbone"
+	// DefaultLeeway is the clock skew tolerated when checking exp, nbf and iat
+	DefaultLeeway = 30 * time.Second
+	// DefaultRefreshInterval is how often the JWKS is refreshed in the background
+	DefaultRefreshInterval = 5 * time.Minute
+	// DefaultMinRefetchInterval is how long to wait between fetches triggered by unknown key IDs
+	DefaultMinRefetchInterval = 10 * time.Second
+)
+
+// maxJWKSSize limits the size of the fetched JWKS
+const maxJWKSSize = 1 << 20
+
+// idTokenType is the typ header of the OpenID Connect ID tokens the issuer signs with the same keys
+const idTokenType = "id_token+jwt"
+
+// Errors returned by Verify. They wrap the underlying error, use errors.Is to check for them
+var (
+	ErrMalformedToken    = errors.New("malformed token")
+	ErrUnknownKey        = errors.New("token is signed with an unknown key")
+	ErrInvalidSignature  = errors.New("invalid token signature")
+	ErrTokenExpired      = errors.New("token has expired")
+	ErrTokenNotYetValid  = errors.New("token is not valid yet")
+	ErrInvalidIssuer     = errors.New("token is issued by another issuer")
+	ErrInvalidAudience   = errors.New("token is not issued for this audience")
+	ErrInvalidToken      = errors.New("invalid token")
+	ErrKeySetUnavailable = errors.New("key set is unavailable")
+)
+
+// Config configures a Verifier
+type Config struct {
+	// JWKSURL is the URL of the JWKS, e.g. http://<IP>/.well-known/jwks.json on the issuer or
+	// the URL of the JWKS file in the S3 bucket
+	JWKSURL string
+	// Issuer is the expected iss claim, DefaultIssuer if empty
+	Issuer string
+	// Audiences the token must be issued for, one of them is enough. Any audience is accepted if empty
+	Audiences []string
+	// Leeway is the clock skew tolerated when checking exp, nbf and iat, DefaultLeeway if zero
+	Leeway time.Duration
+	// RefreshInterval is how often the JWKS is refreshed in the background, DefaultRefreshInterval if zero
+	RefreshInterval time.Duration
+	// MinRefetchInterval limits how often unknown key IDs trigger a fetch, DefaultMinRefetchInterval if zero
+	MinRefetchInterval time.Duration
+	// Algorithms are the accepted signing algorithms, RS256 if empty
+	Algorithms []string
+	// HTTPClient fetches the JWKS, http.DefaultClient if nil
+	HTTPClient *http.Client
+}
+
+// Verifier verifies Tailbone tokens against a cached JWKS
+type Verifier struct {
+	config Config
+	parser *jwt.Parser
+	dpop   *dpop.Verifier
+
+	mu        sync.RWMutex
+	keySet    jwk.Set
+	fetchedAt time.Time
+	// fetchMu serializes fetches, so concurrent unknown key IDs trigger a single one
+	fetchMu sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New creates a verifier, fetches the JWKS and starts refreshing it in the background until
+// Close is called
+func New(ctx context.Context, config Config) (*Verifier, error) {
+	if config.JWKSURL == "" {
+		return nil, errors.New("JWKS URL is required")
+	}
+	if config.Issuer == "" {
+		config.Issuer = DefaultIssuer
+	}
+	if config.Leeway == 0 {
+		config.Leeway = DefaultLeeway
+	}
+	if config.RefreshInterval == 0 {
+		config.RefreshInterval = DefaultRefreshInterval
+	}
+	if config.MinRefetchInterval == 0 {
+		config.MinRefetchInterval = DefaultMinRefetchInterval
+	}
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = []string{jwt.SigningMethodRS256.Alg()}
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+
+	v := &Verifier{
+		config: config,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods(config.Algorithms),
+			jwt.WithIssuer(config.Issuer),
+			jwt.WithLeeway(config.Leeway),
+			jwt.WithExpirationRequired(),
+			jwt.WithIssuedAt(),
+		),
+		dpop: dpop.NewVerifier(dpop.DefaultMaxAge),
+		done: make(chan struct{}),
+	}
+
+	if err := v.Refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	go v.refreshLoop()
+	return v, nil
+}
+
+// Close stops refreshing the JWKS
+func (v *Verifier) Close() {
+	v.closeOnce.Do(func() {
+		close(v.done)
+	})
+}
+
+// Refresh fetches the JWKS now
+func (v *Verifier) Refresh(ctx context.Context) error {
+	v.fetchMu.Lock()
+	defer v.fetchMu.Unlock()
+
+	return v.fetch(ctx)
+}
+
+// Verify verifies a token and returns its claims
+func (v *Verifier) Verify(ctx context.Context, tokenString string) (*TokenClaims, error) {
+	claims := &TokenClaims{}
+	_, err := v.parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ == idTokenType {
+			return nil, fmt.Errorf("%w: ID tokens are not accepted as access tokens", ErrInvalidToken)
+		}
+
+		kid, ok := token.Header["kid"].(string)
+		if !ok || kid == "" {
+			return nil, fmt.Errorf("%w: token has no key ID", ErrUnknownKey)
+		}
+
+		key, err := v.lookupKey(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+
+		return jwk.PublicRawKeyOf(key)
+	})
+	if err != nil {
+		return nil, classifyError(err)
+	}
+
+	if len(v.config.Audiences) > 0 && !slices.ContainsFunc(v.config.Audiences, func(audience string) bool {
+		return slices.Contains(claims.Audience, audience)
+	}) {
+		return nil, ErrInvalidAudience
+	}
+
+	return claims, nil
+}
+
+// lookupKey returns the key kid, refetching the JWKS if it is unknown and was not fetched recently
+func (v *Verifier) lookupKey(ctx context.Context, kid string) (jwk.Key, error) {
+	if key, ok := v.getKeySet().LookupKeyID(kid); ok {
+		return key, nil
+	}
+
+	v.fetchMu.Lock()
+	defer v.fetchMu.Unlock()
+
+	// another caller may have fetched the key while we were waiting
+	if key, ok := v.getKeySet().LookupKeyID(kid); ok {
+		return key, nil
+	}
+
+	v.mu.RLock()
+	fetchedAt := v.fetchedAt
+	v.mu.RUnlock()
+	if time.Since(fetchedAt) >= v.config.MinRefetchInterval {
+		if err := v.fetch(ctx); err != nil {
+			return nil, err
+		}
+		if key, ok := v.getKeySet().LookupKeyID(kid); ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownKey, kid)
+}
+
+func (v *Verifier) getKeySet() jwk.Set {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.keySet
+}
+
+// fetch downloads and parses the JWKS. The caller must hold fetchMu
+func (v *Verifier) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.config.JWKSURL, nil)
+	if err != nil {
+		return fmt.Errorf("%w: failed to create request: %w", ErrKeySetUnavailable, err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := v.config.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: failed to fetch JWKS: %w", ErrKeySetUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: failed to fetch JWKS: %s", ErrKeySetUnavailable, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return fmt.Errorf("%w: failed to read JWKS: %w", ErrKeySetUnavailable, err)
+	}
+
+	keySet, err := jwk.Parse(data)
+	if err != nil {
+		return fmt.Errorf("%w: failed to parse JWKS: %w", ErrKeySetUnavailable, err)
+	}
+
+	v.mu.Lock()
+	v.keySet = keySet
+	v.fetchedAt = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+// refreshLoop refreshes the JWKS until the verifier is closed. Failed refreshes keep the
+// current keys, so an unavailable issuer does not break verification
+func (v *Verifier) refreshLoop() {
+	ticker := time.NewTicker(v.config.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-v.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), v.config.RefreshInterval)
+			v.Refresh(ctx)
+			cancel()
+		}
+	}
+}
+
+// classifyError maps errors of the JWT library to the errors of this package
+func classifyError(err error) error {
+	for _, known := range []error{ErrUnknownKey, ErrKeySetUnavailable, ErrInvalidToken} {
+		if errors.Is(err, known) {
+			return err
+		}
+	}
+
+	var typed error
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		typed = ErrMalformedToken
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		typed = ErrInvalidSignature
+	case errors.Is(err, jwt.ErrTokenExpired):
+		typed = ErrTokenExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		typed = ErrTokenNotYetValid
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		typed = ErrInvalidIssuer
+	default:
+		typed = ErrInvalidToken
+	}
+
+	return fmt.Errorf("%w: %w", typed, err)
+}